@@ -7,4 +7,5 @@ require (
 	github.com/go-ping/ping v0.0.0-20210216210419-25d1413fb7bb
 	github.com/miekg/dns v1.1.31
 	github.com/stretchr/testify v1.7.0 // indirect
+	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd
 )
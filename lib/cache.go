@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"sync"
 	"time"
 
 	"github.com/allegro/bigcache"
@@ -35,16 +36,95 @@ type MemoryCache struct {
 	// bigcache过期是不会删数据的，只有当存储的数据
 	// 多于我们设定的范围，才会用新值覆盖旧值，所以需
 	// 要额外处理过期时间的问题。
-	cache  *bigcache.BigCache
+	cache *bigcache.BigCache
+	// 没有 SOA 记录的否定应答的过期时间
 	Expire time.Duration
+	// 解析结果的过期时间为记录中最小的 TTL，并限制在 MinTTL 和 MaxTTL 之间
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// 否定应答的最长过期时间
+	NegativeMaxTTL time.Duration
+	// 过期之后还可以作为旧的结果返回的最长时间（RFC 8767），为0的时候过期的结果不会再返回
+	MaxStale time.Duration
+	// 返回旧的结果的时候记录的 TTL
+	StaleTTL uint32
+	// 命中次数达到 PrefetchHits，而且剩余时间不超过缓存时间的 PrefetchFraction 的时候需要预取，
+	// PrefetchFraction 为0的时候不预取
+	PrefetchHits     int
+	PrefetchFraction float64
+
+	statsLock sync.Mutex
+	// 每个缓存条目的命中次数等统计
+	stats     map[string]*entryStats
+	lastSweep time.Time
+}
+
+// entryStats 是缓存条目的统计，条目重新缓存的时候命中次数清零
+type entryStats struct {
+	hits int
+	// 缓存时间
+	ttl time.Duration
+	// 条目过期的时间，过期之后不会再预取，统计可以删除
+	evictAt time.Time
+}
+
+const (
+	// 清理过期的统计的间隔
+	statsSweepInterval = time.Minute
+	// 最多保留的统计数量，达到之后先清理过期的统计，仍然达到的时候新缓存的条目不统计，不会被预取
+	maxCacheStats = 100000
+)
+
+// CacheConfig 是解析结果缓存的配置，单位都是秒
+type CacheConfig struct {
+	// 没有 SOA 记录的否定应答（NXDOMAIN 和 NODATA）的过期时间
+	TTL int
+	// 解析结果的过期时间为记录中最小的 TTL，并限制在 MinTTL 和 MaxTTL 之间
+	MinTTL int
+	MaxTTL int
+	// 否定应答的过期时间为 SOA 记录的 TTL 和 MINIMUM 中较小的一个，最长为 NegativeMaxTTL（RFC 2308）
+	NegativeMaxTTL int
+	// 过期之后还可以作为旧的结果返回的最长时间，为0的时候不返回过期的结果（RFC 8767）
+	MaxStale int
+	// 返回旧的结果的时候记录的 TTL
+	StaleTTL int
+	// 命中次数达到 PrefetchHits，而且剩余时间不超过缓存时间的 PrefetchFraction 的时候在后台预取，
+	// PrefetchFraction 为0的时候不预取
+	PrefetchHits     int
+	PrefetchFraction float64
+	// 缓存最多使用的内存，单位MB，达到之后最早缓存的条目会被新的条目覆盖，为0的时候使用 defaultCacheSize
+	Size int
 }
 
-func NewMemoryCache(ttl int) (*MemoryCache, error) {
+// defaultCacheSize 是 CacheConfig.Size 没有设置的时候缓存最多使用的内存，单位MB
+const defaultCacheSize = 2048
+
+// NewMemoryCache 创建解析结果的缓存。
+// 条目在过期之后还要保留 MaxStale，所以 MaxStale 越长，同样的查询量需要的内存越多，
+// 超过 Size 之后最早缓存的条目（包括还没有过期的）会被覆盖。
+func NewMemoryCache(c CacheConfig) (*MemoryCache, error) {
+	if c.MaxTTL < c.MinTTL {
+		c.MaxTTL = c.MinTTL
+	}
+	lifeWindow := c.MaxTTL
+	for _, ttl := range []int{c.TTL, c.NegativeMaxTTL} {
+		if ttl > lifeWindow {
+			lifeWindow = ttl
+		}
+	}
+	// 过期之后在 MaxStale 内还需要保留
+	lifeWindow += c.MaxStale
+	if c.Size <= 0 {
+		c.Size = defaultCacheSize
+	}
 	config := bigcache.Config{
 		// number of shards (must be a power of 2)
 		Shards: 128,
 		// time after which entry can be evicted
-		LifeWindow: time.Duration(ttl) * time.Second,
+		LifeWindow: time.Duration(lifeWindow) * time.Second,
+		// interval between removing expired entries, 0 means expired entries are only
+		// overridden when the cache is full
+		CleanWindow: time.Minute,
 		// rps * lifeWindow, used only in initial memory allocation
 		MaxEntriesInWindow: 1000 * 10 * 60,
 		// max entry size in bytes, used only in initial memory allocation
@@ -54,7 +134,7 @@ func NewMemoryCache(ttl int) (*MemoryCache, error) {
 		// cache will not allocate more memory than this limit, value in MB
 		// if value is reached then the oldest entries can be overridden for the new ones
 		// 0 value means no size limit
-		HardMaxCacheSize: 2048,
+		HardMaxCacheSize: c.Size,
 		// callback fired when the oldest entry is removed because of its
 		// expiration time or no space left for the new entry. Default value is nil which
 		// means no callback and it prevents from unwrapping the oldest entry.
@@ -67,11 +147,29 @@ func NewMemoryCache(ttl int) (*MemoryCache, error) {
 	}
 	mc := &MemoryCache{}
 	mc.cache = cache
-	mc.Expire = config.LifeWindow
+	mc.Expire = time.Duration(c.TTL) * time.Second
+	mc.MinTTL = time.Duration(c.MinTTL) * time.Second
+	mc.MaxTTL = time.Duration(c.MaxTTL) * time.Second
+	mc.NegativeMaxTTL = time.Duration(c.NegativeMaxTTL) * time.Second
+	mc.MaxStale = time.Duration(c.MaxStale) * time.Second
+	mc.StaleTTL = uint32(c.StaleTTL)
+	mc.PrefetchHits = c.PrefetchHits
+	mc.PrefetchFraction = c.PrefetchFraction
+	mc.stats = map[string]*entryStats{}
 	return mc, nil
 }
 
+// Get 返回缓存的解析结果，记录的 TTL 为缓存剩余的时间。
+// 已经过期但没有超过 MaxStale 的结果返回 KeyExpiredError，记录的 TTL 为 StaleTTL，
+// 超过 MaxStale 的结果返回 KeyNotFoundError。
 func (c *MemoryCache) Get(q dns.Question) (*dns.Msg, error) {
+	msg, _, err := c.GetWithPrefetch(q)
+	return msg, err
+}
+
+// GetWithPrefetch 和 Get 一样返回缓存的解析结果，并记录命中次数。
+// 热门的条目快要过期的时候 prefetch 为 true，调用方需要在后台重新查询并缓存。
+func (c *MemoryCache) GetWithPrefetch(q dns.Question) (_ *dns.Msg, prefetch bool, _ error) {
 	key := q.String()
 	v, err := c.cache.Get(key)
 	if err != nil {
@@ -82,12 +180,12 @@ func (c *MemoryCache) Get(q dns.Question) (*dns.Msg, error) {
 		default:
 			AppLog().Errorln("bigcache get error: ", err)
 		}
-		return nil, KeyNotFoundError
+		return nil, false, KeyNotFoundError
 	}
 	// 前15个为过期时间
 	if len(v) < 16 {
 		AppLog().Warnln("cache value's len less than 15")
-		return nil, KeyNotFoundError
+		return nil, false, KeyNotFoundError
 	}
 
 	expireb := v[:15]
@@ -95,26 +193,51 @@ func (c *MemoryCache) Get(q dns.Question) (*dns.Msg, error) {
 	err = expire.UnmarshalBinary(expireb)
 	if err != nil {
 		AppLog().Errorln("UnmarshalBinary error:", err)
-		return nil, KeyNotFoundError
+		return nil, false, KeyNotFoundError
 	}
 
 	var msg dns.Msg
 	err = msg.Unpack(v[15:])
 	if err != nil {
 		AppLog().Errorln("msg.Unpack error: ", err)
-		return nil, KeyNotFoundError
+		return nil, false, KeyNotFoundError
 	}
 
-	if expire.Before(time.Now()) {
-		return &msg, KeyExpiredError
+	remaining := time.Until(expire)
+	if remaining < 0 {
+		if -remaining > c.MaxStale {
+			return nil, false, KeyNotFoundError
+		}
+		setTTL(&msg, c.StaleTTL)
+		return &msg, false, KeyExpiredError
 	}
 
-	return &msg, nil
+	// 记录的 TTL 为缓存剩余的时间
+	setTTL(&msg, uint32(remaining/time.Second))
+	return &msg, c.hit(key, remaining), nil
+}
 
+// hit 增加条目的命中次数，返回是否需要预取
+func (c *MemoryCache) hit(key string, remaining time.Duration) bool {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	st := c.stats[key]
+	if st == nil {
+		// 统计已经被清理，或者条目是在统计之前缓存的
+		return false
+	}
+	st.hits++
+	return c.PrefetchFraction > 0 && st.hits >= c.PrefetchHits &&
+		float64(remaining) <= float64(st.ttl)*c.PrefetchFraction
 }
 
+// Set 缓存解析结果，SERVFAIL、REFUSED 等失败的结果不会被缓存
 func (c *MemoryCache) Set(q dns.Question, msg *dns.Msg) error {
-	expire := time.Now().Add(c.Expire)
+	ttl, ok := c.ttl(msg)
+	if !ok {
+		return nil
+	}
+	expire := time.Now().Add(ttl)
 	expireb, err := expire.MarshalBinary()
 	if err != nil {
 		return err
@@ -131,7 +254,105 @@ func (c *MemoryCache) Set(q dns.Question, msg *dns.Msg) error {
 	key := q.String()
 	// fmt.Println("set", key)
 
-	return c.cache.Set(key, v)
+	if err := c.cache.Set(key, v); err != nil {
+		return err
+	}
+	if c.PrefetchFraction > 0 {
+		c.resetStats(key, ttl, expire)
+	}
+	return nil
+}
+
+// resetStats 在条目重新缓存之后清零命中次数，并定期删除已经过期的条目的统计。
+// 统计的数量达到 maxCacheStats 的时候立即清理，仍然达到的时候不记录这个条目。
+func (c *MemoryCache) resetStats(key string, ttl time.Duration, evictAt time.Time) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	now := time.Now()
+	_, exists := c.stats[key]
+	full := !exists && len(c.stats) >= maxCacheStats
+	if full || now.Sub(c.lastSweep) >= statsSweepInterval {
+		c.lastSweep = now
+		for k, st := range c.stats {
+			if now.After(st.evictAt) {
+				delete(c.stats, k)
+			}
+		}
+		if full && len(c.stats) >= maxCacheStats {
+			return
+		}
+	}
+	c.stats[key] = &entryStats{ttl: ttl, evictAt: evictAt}
+}
+
+// ttl 返回解析结果的过期时间，不能缓存的时候 ok 为 false：
+//   - 只缓存 NOERROR 和 NXDOMAIN 的结果；
+//   - 否定应答的过期时间为 SOA 记录的 TTL 和 MINIMUM 中较小的一个，没有 SOA 记录的时候为 Expire，最长为 NegativeMaxTTL；
+//   - 其他结果的过期时间为记录中最小的 TTL，限制在 MinTTL 和 MaxTTL 之间。
+func (c *MemoryCache) ttl(msg *dns.Msg) (ttl time.Duration, ok bool) {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+
+	if IsNegative(msg) {
+		ttl = c.Expire
+		for _, rr := range msg.Ns {
+			if soa, isSOA := rr.(*dns.SOA); isSOA {
+				ttl = time.Duration(soa.Minttl) * time.Second
+				if soa.Hdr.Ttl < soa.Minttl {
+					ttl = time.Duration(soa.Hdr.Ttl) * time.Second
+				}
+				break
+			}
+		}
+		if ttl > c.NegativeMaxTTL {
+			ttl = c.NegativeMaxTTL
+		}
+		return ttl, true
+	}
+
+	minTTL, _ := minRRTTL(msg)
+	ttl = time.Duration(minTTL) * time.Second
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	return ttl, true
+}
+
+// IsNegative 返回解析结果是否为否定应答：NXDOMAIN，或者没有记录的 NOERROR（NODATA）
+func IsNegative(msg *dns.Msg) bool {
+	return msg.Rcode == dns.RcodeNameError || msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0
+}
+
+// minRRTTL 返回解析结果中所有记录（不包括 OPT）最小的 TTL，没有记录的时候 ok 为 false
+func minRRTTL(msg *dns.Msg) (ttl uint32, ok bool) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !ok || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				ok = true
+			}
+		}
+	}
+	return
+}
+
+// setTTL 把解析结果中所有记录（不包括 OPT）的 TTL 设置为 ttl
+func setTTL(msg *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
 }
 
 func (c *MemoryCache) Length() int {
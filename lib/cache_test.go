@@ -0,0 +1,217 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestCache(t *testing.T, prefetchFraction float64) *MemoryCache {
+	t.Helper()
+	c, err := NewMemoryCache(CacheConfig{
+		TTL: 60, MinTTL: 0, MaxTTL: 3600, NegativeMaxTTL: 3600,
+		MaxStale: 86400, StaleTTL: 30, PrefetchHits: 1, PrefetchFraction: prefetchFraction,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testAnswer(t *testing.T, q dns.Question, ttl uint32) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(q.Name, q.Qtype)
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN A 10.0.0.1", q.Name, ttl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Answer = []dns.RR{rr}
+	return m
+}
+
+// testMsg 返回包含 answer、ns 和 extra 中的记录的响应
+func testMsg(t *testing.T, rcode int, answer, ns, extra []string) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.", dns.TypeA)
+	m.Rcode = rcode
+	for _, section := range []struct {
+		rrs  *[]dns.RR
+		strs []string
+	}{{&m.Answer, answer}, {&m.Ns, ns}, {&m.Extra, extra}} {
+		for _, str := range section.strs {
+			rr, err := dns.NewRR(str)
+			if err != nil {
+				t.Fatal(err)
+			}
+			*section.rrs = append(*section.rrs, rr)
+		}
+	}
+	return m
+}
+
+// withOPT 给 m 加上 OPT 记录，OPT 的 TTL 字段保存的是扩展的响应码和 DO 等标志，不是 TTL，
+// 没有 DO 标志的时候为0
+func withOPT(m *dns.Msg, do bool) *dns.Msg {
+	return m.SetEdns0(4096, do)
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := &MemoryCache{MinTTL: 10 * time.Second, MaxTTL: 100 * time.Second, Expire: 60 * time.Second, NegativeMaxTTL: 3600 * time.Second}
+	tests := []struct {
+		desc string
+		msg  *dns.Msg
+		ttl  time.Duration
+	}{
+		{"record ttl", testMsg(t, dns.RcodeSuccess, []string{"a.example. 50 IN A 10.0.0.1"}, nil, nil), 50 * time.Second},
+		{"minimum of all records", testMsg(t, dns.RcodeSuccess,
+			[]string{"a.example. 80 IN CNAME b.example.", "b.example. 60 IN A 10.0.0.1"},
+			[]string{"example. 40 IN NS ns.example."}, []string{"ns.example. 90 IN A 10.0.0.53"}), 40 * time.Second},
+		{"clamped to min_ttl", testMsg(t, dns.RcodeSuccess, []string{"a.example. 5 IN A 10.0.0.1"}, nil, nil), 10 * time.Second},
+		{"clamped to max_ttl", testMsg(t, dns.RcodeSuccess, []string{"a.example. 500 IN A 10.0.0.1"}, nil, nil), 100 * time.Second},
+		{"OPT ignored", withOPT(testMsg(t, dns.RcodeSuccess, []string{"a.example. 50 IN A 10.0.0.1"}, nil, nil), false), 50 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			ttl, ok := c.ttl(tt.msg)
+			if !ok || ttl != tt.ttl {
+				t.Errorf("ttl() = %s, %t, want %s, true", ttl, ok, tt.ttl)
+			}
+		})
+	}
+}
+
+// TestCacheTTLCountdown 命中缓存的时候记录的 TTL 为缓存剩余的时间，OPT 记录不受影响
+func TestCacheTTLCountdown(t *testing.T) {
+	c := newTestCache(t, 0)
+	q := dns.Question{Name: "a.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if err := c.Set(q, withOPT(testMsg(t, dns.RcodeSuccess, []string{"a.example. 3 IN A 10.0.0.1"}, nil, nil), true)); err != nil {
+		t.Fatal(err)
+	}
+
+	ttlOf := func() uint32 {
+		t.Helper()
+		m, err := c.Get(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opt := m.IsEdns0(); opt == nil || !opt.Do() {
+			t.Errorf("OPT record = %v, want the DO flag kept", opt)
+		}
+		return m.Answer[0].Header().Ttl
+	}
+	first := ttlOf()
+	if first < 2 || first > 3 {
+		t.Fatalf("ttl of the first hit = %d, want 2 or 3", first)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if second := ttlOf(); second >= first {
+		t.Errorf("ttl after 1.1s = %d, want less than %d", second, first)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	c := &MemoryCache{MinTTL: 10 * time.Second, MaxTTL: 100 * time.Second, Expire: 60 * time.Second, NegativeMaxTTL: 900 * time.Second}
+	soa := func(ttl, minimum int) []string {
+		return []string{fmt.Sprintf("example. %d IN SOA ns.example. admin.example. 1 7200 3600 1209600 %d", ttl, minimum)}
+	}
+	tests := []struct {
+		desc string
+		msg  *dns.Msg
+		ttl  time.Duration
+	}{
+		{"NXDOMAIN uses SOA MINIMUM", testMsg(t, dns.RcodeNameError, nil, soa(600, 300), nil), 300 * time.Second},
+		{"NXDOMAIN uses SOA TTL when smaller", testMsg(t, dns.RcodeNameError, nil, soa(120, 300), nil), 120 * time.Second},
+		{"NODATA uses SOA", testMsg(t, dns.RcodeSuccess, nil, soa(600, 200), nil), 200 * time.Second},
+		{"capped by negative_max_ttl", testMsg(t, dns.RcodeNameError, nil, soa(86400, 86400), nil), 900 * time.Second},
+		// 否定应答不受 min_ttl 和 max_ttl 的限制
+		{"not clamped by min_ttl", testMsg(t, dns.RcodeNameError, nil, soa(5, 5), nil), 5 * time.Second},
+		{"cache_ttl without SOA", testMsg(t, dns.RcodeNameError, nil, nil, nil), 60 * time.Second},
+		{"NODATA without SOA", withOPT(testMsg(t, dns.RcodeSuccess, nil, nil, nil), false), 60 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			ttl, ok := c.ttl(tt.msg)
+			if !ok || ttl != tt.ttl {
+				t.Errorf("ttl() = %s, %t, want %s, true", ttl, ok, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestCacheFailuresNotCached(t *testing.T) {
+	c := newTestCache(t, 0)
+	for _, rcode := range []int{dns.RcodeServerFailure, dns.RcodeRefused, dns.RcodeFormatError, dns.RcodeNotImplemented} {
+		q := dns.Question{Name: dns.RcodeToString[rcode] + ".example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		m := testMsg(t, rcode, nil, nil, nil)
+		m.Question[0] = q
+		if err := c.Set(q, m); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Get(q); err != KeyNotFoundError {
+			t.Errorf("%s answer is cached: get error %v", dns.RcodeToString[rcode], err)
+		}
+	}
+	if n := c.Length(); n != 0 {
+		t.Errorf("cache length = %d, want 0", n)
+	}
+}
+
+func TestPrefetchStats(t *testing.T) {
+	q := dns.Question{Name: "a.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	c := newTestCache(t, 0)
+	if err := c.Set(q, testAnswer(t, q, 60)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.stats); n != 0 {
+		t.Errorf("stats with prefetching disabled = %d, want 0", n)
+	}
+
+	c = newTestCache(t, 0.5)
+	if err := c.Set(q, testAnswer(t, q, 60)); err != nil {
+		t.Fatal(err)
+	}
+	st := c.stats[q.String()]
+	if st == nil {
+		t.Fatal("no stats for the cached entry")
+	}
+	// 统计在条目过期的时候删除，不再保留 MaxStale
+	if until := time.Until(st.evictAt); until > time.Minute {
+		t.Errorf("stats evicted in %s, want at the entry expiry", until)
+	}
+	if prefetch := c.hit(q.String(), 10*time.Second); !prefetch {
+		t.Error("hit near expiry does not prefetch")
+	}
+}
+
+func TestPrefetchStatsLimit(t *testing.T) {
+	c := &MemoryCache{stats: map[string]*entryStats{}}
+	now := time.Now()
+	for i := 0; i < maxCacheStats; i++ {
+		c.resetStats(fmt.Sprint(i), time.Minute, now.Add(time.Minute))
+	}
+
+	// 统计都没有过期的时候不记录新的条目，已经统计的条目可以重新记录
+	c.resetStats("new", time.Minute, now.Add(time.Minute))
+	if _, ok := c.stats["new"]; ok || len(c.stats) != maxCacheStats {
+		t.Errorf("stats = %d, new entry recorded %t, want %d without the new entry", len(c.stats), ok, maxCacheStats)
+	}
+	c.resetStats("0", 2*time.Minute, now.Add(2*time.Minute))
+	if st := c.stats["0"]; st.ttl != 2*time.Minute {
+		t.Errorf("existing entry ttl = %s, want 2m", st.ttl)
+	}
+
+	// 有过期的统计的时候立即清理
+	c.stats["1"].evictAt = now.Add(-time.Second)
+	c.resetStats("new", time.Minute, now.Add(time.Minute))
+	if _, ok := c.stats["new"]; !ok || len(c.stats) != maxCacheStats {
+		t.Errorf("stats = %d, new entry recorded %t, want %d with the new entry", len(c.stats), ok, maxCacheStats)
+	}
+	if _, ok := c.stats["1"]; ok {
+		t.Error("expired stats are not removed")
+	}
+}
@@ -255,6 +255,27 @@ func UseStdout(open bool) {
 	setAppLogger(__logFile, __logLevel, open)
 }
 
+// ReopenLogFile 重新打开日志文件，用于 logrotate 移走日志文件之后继续写到新的文件中。
+// 已经通过 AppLog 拿到的 Logger 不需要重新获取。
+func ReopenLogFile() error {
+	dl, ok := __appLogger.(*DefaultLogger)
+	if !ok || len(__logFile) == 0 {
+		return nil
+	}
+	logFile, err := os.OpenFile(__logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	if __useStdout {
+		dl.Logger.SetOutput(io.MultiWriter(logFile, os.Stdout))
+	} else {
+		dl.Logger.SetOutput(logFile)
+	}
+	dl.Close()
+	dl.closable = []io.Closer{logFile}
+	return nil
+}
+
 func SetFileAndLevel(logFile string, levelStr string) {
 	resetAppLogger(logFile, LogLevel(levelStr))
 }
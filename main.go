@@ -1,33 +1,114 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"fpdns/server"
 )
 
+// 收到 SIGTERM 或者 SIGINT 之后等待正在处理的请求完成的最长时间
+const shutdownTimeout = 10 * time.Second
+
 var (
-	confDir  string
-	addr     string
-	httpAddr string
+	confDir   string
+	hostsFile string
+	addr      string
+	httpAddr  string
+
+	cacheTTL            int
+	cacheMinTTL         int
+	cacheMaxTTL         int
+	cacheNegativeMaxTTL int
+	cacheMaxStale       int
+	cacheStaleTTL       int
+	cacheSize           int
+	staleClientTimeout  int
+
+	prefetchHits        int
+	prefetchFraction    float64
+	prefetchConcurrency int
+
+	extraConfDirs      string
+	remoteConf         string
+	remoteConfInterval int
 
-	cacheTTL int
+	leaseFiles  string
+	leaseDomain string
+
+	dockerSocket string
+
+	authZones    string
+	autoPTR      bool
+	watchConf    bool
+	strictReload bool
+	confHistory  int
 
 	logFile  string
 	logLevel int
 )
 
+// confFlags 注册加载配置相关的参数，fpdns 和 fpdns check 共用
+func confFlags(fs *flag.FlagSet) {
+	fs.StringVar(&confDir, "conf_dir", "", "directory included config files. 包含DNS配置的目录")
+	fs.StringVar(&extraConfDirs, "extra_conf_dirs", "", "comma-separated extra directories included config files, lower priority than conf_dir. 额外的配置目录，多个用逗号分隔，优先级低于 conf_dir，前面的优先")
+	fs.StringVar(&hostsFile, "hosts_file", "", "hosts file to load records from, relative to conf_dir. 额外加载的 hosts 文件，例如 /etc/hosts，相对路径相对于 conf_dir")
+	fs.StringVar(&authZones, "auth_zones", "", "comma-separated zones answered authoritatively. 权威区域，多个用逗号分隔，区域内不存在的域名直接返回 NXDOMAIN")
+	fs.BoolVar(&autoPTR, "auto_ptr", false, "generate PTR records for A/AAAA records in .dns-conf files. 为 .dns-conf 中的 A 和 AAAA 记录自动生成 PTR 记录")
+}
+
+// confFromFlags 返回加载配置相关参数的配置
+func confFromFlags() server.ServerConfig {
+	sc := server.ServerConfig{}
+	sc.ConfDir = confDir
+	sc.HostsFile = hostsFile
+	sc.ExtraConfDirs = splitList(extraConfDirs)
+	sc.AutoPTR = autoPTR
+	sc.AuthZones = splitList(authZones)
+	return sc
+}
+
+// splitList 返回逗号分隔的列表中不为空的元素
+func splitList(s string) (list []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return
+}
+
 func parseFlag() {
-	flag.StringVar(&confDir, "conf_dir", "", "directory included config files. 包含DNS配置的目录")
+	confFlags(flag.CommandLine)
 	flag.StringVar(&addr, "addr", ":53", "ip addresses to listen on. 监听的ip和端口， 例如 :53 或者 127.0.0.1:53")
 	flag.StringVar(&httpAddr, "http_addr", ":8666", "http services ip addresses to listen on. http服务监听的ip和端口， 例如 :8666 或者 127.0.0.1:8666")
 
-	flag.IntVar(&cacheTTL, "cache_ttl", 30, "seconds cache TTL. 缓存DNS解析结果的过期时间，单位秒。默认30秒。")
+	flag.StringVar(&remoteConf, "remote_conf", "", "comma-separated HTTP(S) URLs of tar.gz or concatenated .dns-conf bundles, lower priority than local directories. 远程配置的 URL，多个用逗号分隔，内容为 tar.gz 配置包或者拼接在一起的 .dns-conf 文件，优先级低于本地目录")
+	flag.IntVar(&remoteConfInterval, "remote_conf_interval", 60, "seconds between polls of remote_conf. 拉取远程配置的间隔，单位秒。默认60秒。")
+	flag.StringVar(&leaseFiles, "lease_files", "", "comma-separated DHCP lease files (dnsmasq.leases or dhcpd.leases) to publish A and PTR records from. DHCP 租约文件，多个用逗号分隔，支持 dnsmasq.leases 和 dhcpd.leases 格式，有主机名的租约生成 A 和 PTR 记录")
+	flag.StringVar(&leaseDomain, "lease_domain", "lan", "domain of records published from lease_files. 租约生成的记录所在的域名，默认为 lan")
+	flag.StringVar(&dockerSocket, "docker_socket", "", "Docker Engine API unix socket, e.g. /var/run/docker.sock, to publish records of running containers. Docker Engine API 的 unix socket，例如 /var/run/docker.sock，为运行中的容器生成记录")
+	flag.BoolVar(&watchConf, "watch_conf", false, "reload config automatically when files in conf_dir, extra_conf_dirs or hosts_file change. 监听配置目录和 hosts_file，文件变化的时候自动重新加载配置")
+	flag.BoolVar(&strictReload, "strict_reload", false, "abort reloading and keep the old config if any file fails to load. 严格模式，重新加载配置出现任何错误的时候取消加载，继续使用原来的配置")
+	flag.IntVar(&confHistory, "conf_history", 10, "number of loaded config versions kept in memory for rollback. 在内存中保留的配置版本数量，用于回滚。默认10。")
+	flag.IntVar(&cacheTTL, "cache_ttl", 30, "seconds to cache NXDOMAIN and NODATA answers without SOA record. 没有 SOA 记录的否定应答（NXDOMAIN 和 NODATA）的缓存时间，单位秒。默认30秒。")
+	flag.IntVar(&cacheMinTTL, "min_ttl", 0, "minimum seconds to cache answers, the cache time is the minimum TTL of the records clamped by min_ttl and max_ttl. 缓存DNS解析结果的最短时间，单位秒。缓存时间为记录中最小的 TTL，并限制在 min_ttl 和 max_ttl 之间。默认0秒。")
+	flag.IntVar(&cacheMaxTTL, "max_ttl", 86400, "maximum seconds to cache answers. 缓存DNS解析结果的最长时间，单位秒。默认86400秒。")
+	flag.IntVar(&cacheMaxStale, "max_stale", 86400, "maximum seconds to serve an expired answer when upstream fails, 0 to disable serve-stale. 缓存过期之后，上游DNS服务器解析失败的时候还可以返回旧的结果的最长时间，单位秒，为0则不返回过期的结果。默认86400秒。")
+	flag.IntVar(&cacheSize, "cache_size", 2048, "maximum memory of the answer cache in MB, the oldest entries are overwritten when it is full. 解析结果缓存最多使用的内存，单位MB，达到之后最早缓存的条目会被覆盖。默认2048MB。")
+	flag.IntVar(&cacheStaleTTL, "stale_ttl", 30, "TTL in seconds of records in stale answers. 返回旧的结果的时候记录的 TTL，单位秒。默认30秒。")
+	flag.IntVar(&staleClientTimeout, "stale_client_timeout", 1800, "milliseconds to wait for upstream before serving a stale answer while refreshing in the background, 0 to always wait. 有旧的结果的时候等待上游DNS服务器的最长时间，单位毫秒，超时之后先返回旧的结果，在后台继续更新缓存，为0则一直等待。默认1800毫秒。")
+	flag.IntVar(&prefetchHits, "prefetch_hits", 5, "cache hits before an entry is prefetched. 缓存条目的命中次数达到这个值之后才会被预取。默认5。")
+	flag.Float64Var(&prefetchFraction, "prefetch_fraction", 0.1, "prefetch popular entries in the background when the remaining time is within this fraction of their TTL, 0 to disable prefetching. 热门缓存条目剩余时间不超过缓存时间的这个比例的时候在后台预取，为0则不预取。默认0.1。")
+	flag.IntVar(&prefetchConcurrency, "prefetch_concurrency", 10, "maximum concurrent prefetches, must be at least 1 unless prefetch_fraction is 0. 同时预取的最大数量，预取的时候必须大于0。默认10。")
+	flag.IntVar(&cacheNegativeMaxTTL, "negative_max_ttl", 3600, "maximum seconds to cache NXDOMAIN and NODATA answers, which are cached for the SOA MINIMUM. 缓存否定应答（NXDOMAIN 和 NODATA）的最长时间，单位秒，否定应答的缓存时间为 SOA 的 MINIMUM。默认3600秒。")
 	flag.IntVar(&logLevel, "log_level", 5, "log level. 日志打印级别。 NO:0, ERROR:1, WARN:2, NOTICE:3, LOG:4, DEBUG:5 。默认5.")
 	flag.StringVar(&logFile, "log_file", "", "log file to send write to instead of stdout - has to be a file, not directory. 日志文件路径，默认输出到标准输出")
 
@@ -38,25 +119,81 @@ func parseFlag() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if prefetchFraction > 0 && prefetchConcurrency < 1 {
+		fmt.Println("prefetch_concurrency 必须大于0，不预取的时候设置 prefetch_fraction 为0")
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// checkConf 执行 fpdns check 子命令，离线检查配置目录，有错误的时候返回1，
+// 指定了 -strict 并且只有警告的时候返回2
+func checkConf(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	confFlags(fs)
+	strict := fs.Bool("strict", false, "exit with status 2 if there are warnings. 有警告的时候退出码为2")
+	fs.Parse(args)
+
+	if confDir == "" {
+		fmt.Println("配置目录 conf_dir 参数必须指定")
+		fs.Usage()
+		return 1
+	}
+
+	errCount, warnCount := server.CheckConf(confFromFlags(), os.Stdout)
+	return server.CheckExitCode(errCount, warnCount, *strict)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(checkConf(os.Args[2:]))
+	}
+
 	parseFlag()
 
-	sc := server.ServerConfig{}
+	sc := confFromFlags()
 	sc.Addr = addr
+	sc.RemoteConfURLs = splitList(remoteConf)
+	sc.RemoteConfInterval = remoteConfInterval
+	sc.LeaseFiles = splitList(leaseFiles)
+	sc.LeaseDomain = leaseDomain
+	sc.DockerSocket = dockerSocket
 	sc.CacheTTL = cacheTTL
-	sc.ConfDir = confDir
+	sc.CacheMinTTL = cacheMinTTL
+	sc.CacheMaxTTL = cacheMaxTTL
+	sc.CacheNegativeMaxTTL = cacheNegativeMaxTTL
+	sc.CacheMaxStale = cacheMaxStale
+	sc.CacheStaleTTL = cacheStaleTTL
+	sc.CacheSize = cacheSize
+	sc.StaleClientTimeout = staleClientTimeout
+	sc.PrefetchHits = prefetchHits
+	sc.PrefetchFraction = prefetchFraction
+	sc.PrefetchConcurrency = prefetchConcurrency
+	sc.WatchConf = watchConf
+	sc.StrictReload = strictReload
+	sc.ConfHistory = confHistory
 	sc.HttpAddr = httpAddr
 	sc.LogFile = logFile
 	sc.LogLevel = logLevel
 
 	server.StartServer(sc)
 
+	// SIGHUP 重新加载配置并重新打开日志文件，SIGTERM 和 SIGINT 优雅退出
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP)
-	func() {
-		<-c
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range c {
+		if sig == syscall.SIGHUP {
+			server.Reload()
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			fmt.Println("shutdown error:", err)
+			os.Exit(1)
+		}
 		os.Exit(0)
-	}()
+	}
 }
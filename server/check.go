@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CheckConf 离线检查配置目录中的 .dns-conf、hosts 和 resolv.conf 文件，
+// 把发现的错误和问题输出到 w，返回错误和警告的数量。
+//
+// 错误是加载配置时会被跳过的内容，警告是可以加载但可能不符合预期的配置：
+// 重复的记录、CNAME 和其他记录在同一个名字下、超过 maxCNAMEDepth 层或者循环的 CNAME 链，
+// 以及被明确配置的名字或者空的中间节点遮住的泛解析记录。
+func CheckConf(c ServerConfig, w io.Writer) (errCount, warnCount int) {
+	l := newConfLoader(c)
+	l.loadSources()
+	errs := l.errs
+	if l.resolvConf != "" {
+		if clientConfig, err := dns.ClientConfigFromFile(l.resolvConf); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", l.resolvConf, err))
+		} else if len(clientConfig.Servers) == 0 {
+			errs = append(errs, fmt.Errorf("%s: no nameserver", l.resolvConf))
+		}
+	}
+	for _, err := range errs {
+		fmt.Fprintf(w, "ERROR: %s\n", err)
+	}
+
+	records, sources := l.finish()
+	warnings := lintRecords(newRRSnapshot(records, sources, c.AuthZones))
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "WARN: %s\n", warning)
+	}
+
+	fmt.Fprintf(w, "%d errors, %d warnings\n", len(errs), len(warnings))
+	return len(errs), len(warnings)
+}
+
+// CheckExitCode 返回 fpdns check 的退出码：有错误的时候为1，strict 为 true 并且只有警告的时候为2，否则为0
+func CheckExitCode(errCount, warnCount int, strict bool) int {
+	if errCount > 0 {
+		return 1
+	} else if strict && warnCount > 0 {
+		return 2
+	}
+	return 0
+}
+
+// lintRecords 检查加载的记录中可能不符合预期的配置，返回排好序的警告信息
+func lintRecords(s *rrSnapshot) (warnings []string) {
+	for name, rrsAll := range s.records {
+		for t, rrs := range rrsAll {
+			for i := range rrs {
+				for j := 0; j < i; j++ {
+					if dns.IsDuplicate(rrs[i], rrs[j]) {
+						warnings = append(warnings, fmt.Sprintf("duplicate record: %s", rrs[i]))
+						break
+					}
+				}
+			}
+
+			if t[1] == dns.TypeCNAME && len(rrsAll) > 1 {
+				var others []string
+				for t2 := range rrsAll {
+					if t2[1] != dns.TypeCNAME {
+						others = append(others, dns.TypeToString[t2[1]])
+					}
+				}
+				sort.Strings(others)
+				warnings = append(warnings, fmt.Sprintf("CNAME and other data at %s: %s", name, strings.Join(others, ", ")))
+			}
+			if t[1] == dns.TypeCNAME {
+				if problem := checkCNAMEChain(s, name); problem != "" {
+					warnings = append(warnings, problem)
+				}
+			}
+		}
+	}
+
+	for parent := range s.wildcards {
+		wildcard := wildcardName(parent)
+		for name := range s.names {
+			if name == wildcard || name == "." || dnsParent(name) != parent {
+				continue
+			}
+			// 明确配置的名字遮住泛解析对它的子域名的匹配，空的中间节点还会遮住它自己
+			if _, ok := s.records[name]; ok {
+				warnings = append(warnings, fmt.Sprintf("wildcard %s does not match subdomains of %s: %s is configured explicitly", wildcard, name, name))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("wildcard %s does not match %s and its subdomains: %s exists as an empty non-terminal", wildcard, name, name))
+			}
+		}
+	}
+
+	sort.Strings(warnings)
+	return
+}
+
+// checkCNAMEChain 沿着本地配置的 CNAME 链查找，链循环或者超过 maxCNAMEDepth 层的时候返回问题描述
+func checkCNAMEChain(s *rrSnapshot, name string) string {
+	seen := map[string]bool{name: true}
+	chain := []string{name}
+	for cur := name; ; {
+		rrsAll, _, ok := s.lookup(cur)
+		if !ok {
+			return ""
+		}
+		rrs := rrsAll[[2]uint16{dns.ClassINET, dns.TypeCNAME}]
+		if len(rrs) == 0 {
+			return ""
+		}
+		target := strings.ToLower(rrs[0].(*dns.CNAME).Target)
+		if target == "direct." {
+			return ""
+		}
+		chain = append(chain, target)
+		if seen[target] {
+			return fmt.Sprintf("CNAME loop: %s", strings.Join(chain, " -> "))
+		}
+		if len(chain)-1 > maxCNAMEDepth {
+			return fmt.Sprintf("CNAME chain deeper than %d: %s", maxCNAMEDepth, strings.Join(chain, " -> "))
+		}
+		seen[target] = true
+		cur = target
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestLintRecordsWildcard(t *testing.T) {
+	s := testSnapshot(t,
+		"*.example. 60 IN A 10.0.0.1",
+		"x.example. 60 IN A 10.0.0.2",
+		"a.b.example. 60 IN A 10.0.0.3",
+	)
+	warnings := lintRecords(s)
+	want := []string{
+		"wildcard *.example. does not match b.example. and its subdomains: b.example. exists as an empty non-terminal",
+		"wildcard *.example. does not match subdomains of x.example.: x.example. is configured explicitly",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("warnings =\n%s\nwant\n%s", strings.Join(warnings, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestCheckShadowedWildcard 被遮住的泛解析记录只是警告，指定了 -strict 的时候退出码为2
+func TestCheckShadowedWildcard(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"test.dns-conf": "*.example. IN A 10.0.0.1\nx.example. IN A 10.0.0.2\n",
+	})
+	var out strings.Builder
+	errCount, warnCount := CheckConf(ServerConfig{ConfDir: dir}, &out)
+	if errCount != 0 || warnCount != 1 || !strings.Contains(out.String(), "WARN: wildcard *.example. does not match subdomains of x.example.") {
+		t.Fatalf("CheckConf() = %d errors, %d warnings, want 0 and 1, output:\n%s", errCount, warnCount, out.String())
+	}
+	if code := CheckExitCode(errCount, warnCount, false); code != 0 {
+		t.Errorf("exit code without -strict = %d, want 0", code)
+	}
+	if code := CheckExitCode(errCount, warnCount, true); code != 2 {
+		t.Errorf("exit code with -strict = %d, want 2", code)
+	}
+	if code := CheckExitCode(1, warnCount, false); code != 1 {
+		t.Errorf("exit code with errors = %d, want 1", code)
+	}
+}
+
+func TestCheckConfKeepsServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"test.dns-conf": "a.example. IN A 10.0.0.1\na.example. IN A 10.0.0.1\nbad IN A 10.0.0.300\n",
+	})
+	sc = ServerConfig{ConfDir: "/running"}
+	errCount, warnCount := CheckConf(ServerConfig{ConfDir: dir}, ioutil.Discard)
+	if errCount != 1 || warnCount != 1 {
+		t.Errorf("CheckConf() = %d errors, %d warnings, want 1 and 1", errCount, warnCount)
+	}
+	if sc.ConfDir != "/running" {
+		t.Errorf("CheckConf() changes the server config to %+v", sc)
+	}
+}
+
+func TestCheckConfCNAME(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"test.dns-conf": "a.example. IN CNAME b.example.\nb.example. IN CNAME a.example.\nc.example. IN CNAME d.example.\nc.example. IN TXT \"x\"\n",
+	})
+	var out strings.Builder
+	CheckConf(ServerConfig{ConfDir: dir}, &out)
+	for _, want := range []string{"CNAME loop: a.example. -> b.example. -> a.example.", "CNAME and other data at c.example.: TXT"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
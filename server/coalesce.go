@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// inflightLookup 是一个正在进行的上游查询，完成之后关闭 done
+type inflightLookup struct {
+	done    chan struct{}
+	message *dns.Msg
+	err     error
+}
+
+var (
+	inflightLock sync.Mutex
+	// 正在进行的上游查询，key 见 coalesceKey
+	inflightLookups = map[string]*inflightLookup{}
+	// 合并到其他正在进行的查询中的次数
+	coalescedLookups int64
+)
+
+// coalesceLookup 合并同时进行的相同的上游查询：同一个 key 同时只调用一次 lookup，
+// 其他请求等待这次查询的结果。每个请求得到的都是结果的副本，消息ID和问题都设置为自己的请求中的值。
+func coalesceLookup(netType string, r *dns.Msg, lookup func() (*dns.Msg, error)) (*dns.Msg, error) {
+	key := coalesceKey(netType, r)
+
+	inflightLock.Lock()
+	l, ok := inflightLookups[key]
+	if !ok {
+		l = &inflightLookup{done: make(chan struct{})}
+		inflightLookups[key] = l
+	}
+	inflightLock.Unlock()
+
+	if ok {
+		atomic.AddInt64(&coalescedLookups, 1)
+		<-l.done
+	} else {
+		l.message, l.err = lookup()
+		inflightLock.Lock()
+		delete(inflightLookups, key)
+		inflightLock.Unlock()
+		close(l.done)
+	}
+
+	if l.err != nil || l.message == nil {
+		return nil, l.err
+	}
+	m := l.message.Copy()
+	m.Id = r.Id
+	m.Question = append([]dns.Question(nil), r.Question...)
+	return m, nil
+}
+
+// coalesceKey 返回合并查询使用的 key：网络类型、问题（域名不区分大小写），
+// 以及会影响上游结果的 CD 标志、是否有 EDNS 和 DO 标志
+func coalesceKey(netType string, r *dns.Msg) string {
+	q := r.Question[0]
+	key := fmt.Sprintf("%s %s %d %d cd=%t", netType, strings.ToLower(q.Name), q.Qclass, q.Qtype, r.CheckingDisabled)
+	if opt := r.IsEdns0(); opt != nil {
+		key += fmt.Sprintf(" edns do=%t", opt.Do())
+	}
+	return key
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCoalesceLookup(t *testing.T) {
+	setupTestConf(t, nil)
+	useTestCache(t, testCacheConfig)
+	const callers = 8
+	release := make(chan struct{})
+	upstream := startFakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		<-release
+		w.WriteMsg(answerWith(t, r, "a.example. 60 IN A 10.0.0.1"))
+	})
+
+	coalesced := atomic.LoadInt64(&coalescedLookups)
+	var wg sync.WaitGroup
+	replies := make([]*dns.Msg, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := new(dns.Msg)
+			// 域名的大小写不同也会被合并
+			r.SetQuestion("a.example.", dns.TypeA)
+			if i%2 == 1 {
+				r.Question[0].Name = "A.Example."
+			}
+			r.Id = uint16(1000 + i)
+			replies[i], errs[i] = queryDnsResult("udp", r, 0)
+		}(i)
+	}
+	// 所有请求都在等待第一个请求的上游查询之后再返回结果
+	waitFor(t, "callers to coalesce", func() bool {
+		return atomic.LoadInt64(&coalescedLookups)-coalesced == callers-1
+	})
+	close(release)
+	wg.Wait()
+
+	if n := upstream.count(); n != 1 {
+		t.Errorf("upstream queries = %d, want 1", n)
+	}
+	for i, m := range replies {
+		if errs[i] != nil {
+			t.Errorf("caller %d: %s", i, errs[i])
+			continue
+		}
+		wantName := "a.example."
+		if i%2 == 1 {
+			wantName = "A.Example."
+		}
+		if m.Id != uint16(1000+i) || len(m.Question) != 1 || m.Question[0].Name != wantName {
+			t.Errorf("caller %d reply id %d, question %v, want id %d and %s", i, m.Id, m.Question, 1000+i, wantName)
+		}
+		if len(m.Answer) != 1 {
+			t.Errorf("caller %d answers = %v, want 1", i, m.Answer)
+		}
+	}
+	// 每个请求得到的是副本
+	if len(replies) > 1 && replies[0].Answer[0] == replies[1].Answer[0] {
+		t.Error("callers share the same answer records")
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	query := func(name string, edns, do, cd bool) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		r.CheckingDisabled = cd
+		if edns {
+			r.SetEdns0(4096, do)
+		}
+		return r
+	}
+	base := coalesceKey("udp", query("a.example.", false, false, false))
+	if key := coalesceKey("udp", query("A.EXAMPLE.", false, false, false)); key != base {
+		t.Errorf("key of the upper case name = %q, want %q", key, base)
+	}
+
+	keys := map[string]string{"base": base}
+	for desc, key := range map[string]string{
+		"tcp":     coalesceKey("tcp", query("a.example.", false, false, false)),
+		"cd":      coalesceKey("udp", query("a.example.", false, false, true)),
+		"edns":    coalesceKey("udp", query("a.example.", true, false, false)),
+		"edns do": coalesceKey("udp", query("a.example.", true, true, false)),
+	} {
+		for other, otherKey := range keys {
+			if key == otherKey {
+				t.Errorf("%s and %s queries share the key %q", desc, other, key)
+			}
+		}
+		keys[desc] = key
+	}
+}
@@ -1,156 +1,363 @@
 package server
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"hash"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/miekg/dns"
 )
 
-func loadConf(_confDir string) {
-	err := filepath.Walk(_confDir, func(path string, f os.FileInfo, err error) error {
+// loadConf 启动时加载所有 Provider 的记录
+func loadConf() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	newSnapshot, loaded, errs, _ := loadProviders()
+	logConfErrors(errs, newSnapshot)
+	diff := getDiffDNSConf(currentRRSnapshot(), newSnapshot)
+	saveProviderRRsets(loaded)
+	confFiles.commit()
+	commitSnapshot(newSnapshot, confFiles.applied.checksum, "startup", diff)
+}
+
+// confLoader 用于加载一次配置，保存加载的记录和加载过程中的状态。
+//
+// 记录可以来自多个来源：-conf_dir 配置目录（包括 -hosts_file）、-extra_conf_dirs 中的目录和
+// -remote_conf 中的远程配置，按这个顺序优先级从高到低。同一个 RRset（名字、class 和 type 都相同）
+// 只使用优先级最高的来源中的记录，同一个来源中的记录会合并在一起。
+type confLoader struct {
+	// 加载使用的配置
+	conf ServerConfig
+	// 当前正在加载的目录，$INCLUDE 的相对路径相对于这个目录
+	confDir string
+	// 当前正在加载的来源
+	source *sourceRecords
+	// 每个来源加载的记录，按优先级从高到低排列
+	sources []*sourceRecords
+
+	// 合并之后的记录和每个 RRset 的来源，finish 之后才有内容
+	records       map[string]map[[2]uint16][]dns.RR
+	recordSources map[string]map[[2]uint16]string
+
+	// 所有加载的记录文件的路径和内容的 sha256
+	sum hash.Hash
+	// 配置目录中找到的 resolv.conf 文件
+	resolvConf string
+	// 需要自动生成 PTR 记录的 A 和 AAAA 记录，按加载的顺序保存
+	autoPTRs []autoPTRCandidate
+	// 加载过程中出现的错误，包含了出错的文件和行号
+	errs []error
+}
+
+// sourceRecords 是一个来源加载的记录
+type sourceRecords struct {
+	// 来源的名字，本地目录为目录的路径，远程配置为去掉了密码的 URL
+	label   string
+	records map[string]map[[2]uint16][]dns.RR
+}
+
+// autoPTRCandidate 是需要自动生成 PTR 记录的 A 或者 AAAA 记录和它的来源
+type autoPTRCandidate struct {
+	rr     dns.RR
+	source string
+}
+
+func newConfLoader(c ServerConfig) *confLoader {
+	return &confLoader{
+		conf:          c,
+		records:       map[string]map[[2]uint16][]dns.RR{},
+		recordSources: map[string]map[[2]uint16]string{},
+		sum:           sha256.New(),
+	}
+}
+
+// loadSources 按优先级从高到低加载所有来源中的记录
+func (l *confLoader) loadSources() {
+	l.beginSource(l.conf.ConfDir)
+	l.loadDir(l.conf.ConfDir)
+	l.loadConfiguredHostsFile()
+	for _, dir := range l.conf.ExtraConfDirs {
+		l.beginSource(dir)
+		l.loadDir(dir)
+	}
+	for _, r := range remoteConfs {
+		l.beginSource(r.label)
+		l.loadRemote(r)
+	}
+}
+
+// beginSource 开始加载一个新的来源，之后加载的记录都属于这个来源
+func (l *confLoader) beginSource(label string) {
+	l.source = &sourceRecords{label: label, records: map[string]map[[2]uint16][]dns.RR{}}
+	l.sources = append(l.sources, l.source)
+}
+
+// loadDir 加载目录中所有的记录文件，-conf_dir 中的 resolv.conf 为上游DNS服务器的配置
+func (l *confLoader) loadDir(dir string) {
+	l.confDir = dir
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
 		if f == nil {
+			if err != nil {
+				l.errs = append(l.errs, err)
+			}
 			return nil
 		}
 		if f.IsDir() {
 			return nil
 		}
 
-		if strings.HasSuffix(path, ".dns-conf") {
-			loadDNSConf(path, f, nil)
-		} else if filepath.Base(path) == "resolv.conf" {
-			resolvConfFile = path
+		if l.loadFile(path) {
+			return nil
+		} else if filepath.Base(path) == "resolv.conf" && dir == l.conf.ConfDir {
+			l.resolvConf = path
 		}
 		return nil
 	})
 	if err != nil {
-		// fmt.Printf("filepath.Walk() returned %v\n", err)
-		logInstance.Errorf("filepath.Walk() returned: %v\n", err)
+		l.errs = append(l.errs, fmt.Errorf("filepath.Walk() returned: %v", err))
 	}
 }
 
-func loadDNSConf(path string, f os.FileInfo, reloadRRCache map[string]map[[2]uint16][]dns.RR) {
-	rrCache2 := rrCache
-	if reloadRRCache != nil {
-		rrCache2 = reloadRRCache
+// logConfErrors 打印加载过程中出现的错误，以及 newSnapshot 中当前的快照没有的合并冲突
+func logConfErrors(errs []error, newSnapshot *rrSnapshot) {
+	for _, err := range errs {
+		logInstance.Warnf("load conf error: %s\n", err)
+	}
+	old := map[string]bool{}
+	for _, conflict := range currentRRSnapshot().conflicts {
+		old[conflict] = true
 	}
+	for _, conflict := range newSnapshot.conflicts {
+		if !old[conflict] {
+			logInstance.Warnf("merge conf conflict: %s\n", conflict)
+		}
+	}
+}
 
-	inFile, err := os.Open(path)
-	if err != nil {
-		logInstance.Errorf("load conf file [%s] error: %s \n", path, err)
+// loadFile 根据文件后缀加载 .dns-conf 或者 .hosts 文件中的记录，不是记录文件的时候返回 false
+func (l *confLoader) loadFile(path string) bool {
+	switch {
+	case strings.HasSuffix(path, ".dns-conf"):
+		l.loadDNSConf(path)
+	case strings.HasSuffix(path, ".hosts"):
+		l.loadHostsFile(path)
+	default:
+		return false
+	}
+	return true
+}
+
+// loadConfiguredHostsFile 加载 ServerConfig.HostsFile 指定的 hosts 文件，相对路径相对于配置目录
+func (l *confLoader) loadConfiguredHostsFile() {
+	path := l.conf.hostsFilePath()
+	if path == "" {
 		return
 	}
-	defer inFile.Close()
-	scanner := bufio.NewScanner(inFile)
-	scanner.Split(bufio.ScanLines)
+	if strings.HasSuffix(path, ".hosts") && strings.HasPrefix(path, filepath.Clean(l.confDir)+string(filepath.Separator)) {
+		// 已经在遍历配置目录的时候加载过了
+		return
+	}
+	l.loadHostsFile(path)
+}
 
-	for scanner.Scan() {
-		rrConf := strings.TrimSpace(scanner.Text())
-		if len(rrConf) < 1 || strings.HasPrefix(rrConf, "#") {
-			continue
-		}
-		rr, err := dns.NewRR(rrConf)
-		if err != nil {
-			logInstance.Warnf("load conf [%s] from file [%s] error: %s\n", rrConf, path, err)
-		} else {
-			h := rr.Header()
-			if h == nil {
-				logInstance.Warnf("load conf [%s] from file [%s] error: can't get RR_Header\n", rrConf, path)
-			} else {
-				if h.Rrtype == dns.TypePTR { // PTR 反向解析需要特殊处理一下
-					h.Name, err = dns.ReverseAddr(strings.Trim(h.Name, "."))
-					if err != nil {
-						logInstance.Warnf("load conf [%s] from file [%s] error: wrong PRT record, %s\n", rrConf, path, err)
-						continue
-					}
-				}
-				h.Name = strings.ToLower(h.Name)
-				// c := rrCache2[[2]uint16{h.Class, h.Rrtype}]
-				c := rrCache2[h.Name]
-				if c == nil {
-					c = map[[2]uint16][]dns.RR{}
-					rrCache2[h.Name] = c
-				}
-				c[[2]uint16{h.Class, h.Rrtype}] = append(c[[2]uint16{h.Class, h.Rrtype}], rr)
-			}
-		}
+// hostsFilePath 返回 HostsFile 指定的 hosts 文件的路径，相对路径相对于配置目录，没有指定的时候返回空字符串
+func (c ServerConfig) hostsFilePath() string {
+	if c.HostsFile == "" || filepath.IsAbs(c.HostsFile) {
+		return c.HostsFile
 	}
+	return filepath.Join(c.ConfDir, c.HostsFile)
 }
 
-// reloadDNSConf 重新加载dns配置，并且返回增加、删除和修改过的记录
-func reloadDNSConf() (add, del, change []string) {
-	newRRCache := map[string]map[[2]uint16][]dns.RR{}
-	// newRRCache[[2]uint16{dns.ClassINET, dns.TypeA}] = map[string][]dns.RR{}
+// readFile 读取记录文件的内容，并计入 checksum
+func (l *confLoader) readFile(path string) ([]byte, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.errs = append(l.errs, err)
+		return nil, false
+	}
+	l.addChecksum(path, data)
+	return data, true
+}
 
-	err := filepath.Walk(sc.ConfDir, func(path string, f os.FileInfo, err error) error {
-		if f == nil {
-			return nil
-		}
-		if f.IsDir() {
-			return nil
+// addChecksum 把记录文件的路径和内容计入 checksum
+func (l *confLoader) addChecksum(path string, data []byte) {
+	l.sum.Write([]byte(path))
+	l.sum.Write([]byte{0})
+	l.sum.Write(data)
+	l.sum.Write([]byte{0})
+}
+
+// loadDNSConf 加载 .dns-conf 配置文件中的记录
+func (l *confLoader) loadDNSConf(path string) {
+	if data, ok := l.readFile(path); ok {
+		l.addDNSConf(l.confDir, path, data)
+	}
+}
+
+// addDNSConf 解析 .dns-conf 格式的内容，把记录加到当前的来源中
+func (l *confLoader) addDNSConf(confDir, path string, data []byte) {
+	rrs, opts, errs := parseDNSConf(confDir, path, data)
+	l.errs = append(l.errs, errs...)
+	l.addRecords(path, rrs)
+
+	autoPTR := l.conf.AutoPTR
+	if opts.autoPTR != nil {
+		autoPTR = *opts.autoPTR
+	}
+	if autoPTR {
+		for _, rr := range rrs {
+			if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				l.autoPTRs = append(l.autoPTRs, autoPTRCandidate{rr, l.source.label})
+			}
 		}
+	}
+}
 
-		if strings.HasSuffix(path, ".dns-conf") {
-			loadDNSConf(path, f, newRRCache)
+// addHosts 解析 hosts 格式的内容，把记录加到当前的来源中
+func (l *confLoader) addHosts(path string, data []byte) {
+	rrs, errs := parseHostsFile(path, bytes.NewReader(data))
+	l.errs = append(l.errs, errs...)
+	l.addRecords(path, rrs)
+}
+
+// addRecords 把从 path 文件加载的记录加到当前的来源中
+func (l *confLoader) addRecords(path string, rrs []dns.RR) {
+	for _, rr := range rrs {
+		h := rr.Header()
+		// PTR 反向解析需要特殊处理一下，配置的记录名可以直接写IP
+		if h.Rrtype == dns.TypePTR && !isReverseName(strings.ToLower(h.Name)) {
+			reverse, err := dns.ReverseAddr(strings.Trim(h.Name, "."))
+			if err != nil {
+				l.errs = append(l.errs, fmt.Errorf("%s: wrong PTR record [%s]: %s", path, rr, err))
+				continue
+			}
+			h.Name = reverse
 		}
-		return nil
-	})
-	if err != nil {
-		// fmt.Printf("filepath.Walk() returned %v\n", err)
-		logInstance.Errorf("filepath.Walk() returned: %v\n", err)
+		h.Name = strings.ToLower(h.Name)
+		addRecord(l.source.records, rr)
 	}
+}
 
-	add, del, change = getDiffDNSConf(rrCache, newRRCache)
-	rrCache = newRRCache
-	return
+// addRecord 把记录加到 records 中对应的 RRset
+func addRecord(records map[string]map[[2]uint16][]dns.RR, rr dns.RR) {
+	h := rr.Header()
+	c := records[h.Name]
+	if c == nil {
+		c = map[[2]uint16][]dns.RR{}
+		records[h.Name] = c
+	}
+	c[[2]uint16{h.Class, h.Rrtype}] = append(c[[2]uint16{h.Class, h.Rrtype}], rr)
 }
 
-// getDiffDNSConf 返回增加、删除和修改过的记录
-func getDiffDNSConf(oldC, newC map[string]map[[2]uint16][]dns.RR) (add, del, change []string) {
-	for name, newM := range newC {
-		if oldM, ok := oldC[name]; ok {
-			for t, newRR := range newM {
-				if oldRR, ok := oldM[t]; ok {
-					sNewRR := make([]string, 0, len(newRR))
-					sOldRR := make([]string, 0, len(oldRR))
-					for _, v := range newRR {
-						sNewRR = append(sNewRR, v.String())
-					}
-					for _, v := range oldRR {
-						sOldRR = append(sOldRR, v.String())
-					}
-					if !reflect.DeepEqual(sNewRR, sOldRR) {
-						for _, rr := range newRR {
-							change = append(change, fmt.Sprintf("%s", rr.String()))
-						}
-					}
-				} else {
-					for _, rr := range newRR {
-						add = append(add, fmt.Sprintf("%s", rr.String()))
-					}
+// finish 完成加载，按优先级合并所有来源的记录并生成自动的 PTR 记录，
+// 返回合并之后的记录和每个 RRset 的来源
+func (l *confLoader) finish() (map[string]map[[2]uint16][]dns.RR, map[string]map[[2]uint16]string) {
+	for _, source := range l.sources {
+		for name, rrsAll := range source.records {
+			for t, rrs := range rrsAll {
+				if _, ok := l.records[name][t]; ok {
+					// 优先级更高的来源中已经有这个 RRset
+					continue
 				}
-			}
-		} else {
-			for _, newRR := range newM {
-				for _, rr := range newRR {
-					add = append(add, fmt.Sprintf("%s", rr.String()))
+				for _, rr := range rrs {
+					l.addMerged(rr, source.label)
 				}
-
 			}
 		}
 	}
-	for name, oldRR := range oldC {
-		if _, ok := newC[name]; !ok {
-			for _, rrs := range oldRR {
-				for _, rr := range rrs {
-					del = append(del, fmt.Sprintf("%s", rr.String()))
-				}
+	l.synthesizePTRs()
+	return l.records, l.recordSources
+}
+
+// addMerged 把来自 source 的记录加到合并之后的记录中
+func (l *confLoader) addMerged(rr dns.RR, source string) {
+	addRecord(l.records, rr)
+	h := rr.Header()
+	if l.recordSources[h.Name] == nil {
+		l.recordSources[h.Name] = map[[2]uint16]string{}
+	}
+	l.recordSources[h.Name][[2]uint16{h.Class, h.Rrtype}] = source
+}
+
+// reloadLock 保证同一时间只有一个重新加载配置的操作，查询不需要加锁
+var reloadLock sync.Mutex
+
+// confErrors 是严格模式下加载配置出现的错误，出现错误的时候取消重新加载
+type confErrors []error
+
+func (e confErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reloadDNSConf 重新加载 providers 的记录，没有指定的时候重新加载所有 Provider 的记录，
+// 其他 Provider 使用最后一次加载的记录，返回每个 RRset 的变化和加载过程中出现的错误。
+// 配置文件有变化的时候记录到配置历史中，只有其他 Provider 的记录变化的时候不产生新的版本，reason 为重新加载的原因。
+// dryRun 为 true 的时候只返回变化，不替换正在使用的配置。
+// 开启了 ServerConfig.StrictReload 并且指定的 Provider 出现错误的时候，继续使用原来的配置并返回 confErrors；
+// 重新加载所有 Provider 的时候只有配置文件出错才取消，出错的租约文件、Docker 等 Provider
+// 继续使用最后一次成功加载的记录，错误在 errs 中返回，不会阻止修复之后的配置文件生效。
+//
+// 回滚之后配置文件固定在回滚到的版本，只重新加载配置文件的时候会被忽略，重新加载所有 Provider 的时候取消固定。
+func reloadDNSConf(reason string, dryRun bool, providers ...Provider) (diff confDiff, errs []error, err error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if pinnedConfVersion != 0 && containsProvider(providers, confFiles) {
+		logInstance.Logf("%s, conf files are pinned to version %d by rollback, ignored until /reload_conf\n", reason, pinnedConfVersion)
+		var others []Provider
+		for _, p := range providers {
+			if p != confFiles {
+				others = append(others, p)
 			}
 		}
+		if len(others) == 0 {
+			return
+		}
+		providers = others
+	}
+
+	newSnapshot, loaded, errs, rejected := loadProviders(providers...)
+	logConfErrors(errs, newSnapshot)
+	required := providers
+	if len(required) == 0 {
+		required = []Provider{confFiles}
+	}
+	for _, p := range rejected {
+		if containsProvider(required, p) {
+			return nil, errs, confErrors(errs)
+		}
+	}
+
+	diff = getDiffDNSConf(currentRRSnapshot(), newSnapshot)
+	if dryRun {
+		return
+	}
+	saveProviderRRsets(loaded)
+	if len(providers) > 0 && !containsProvider(providers, confFiles) {
+		// 只有租约文件、Docker 等 Provider 的记录变化，不产生新的版本
+		storeRRSnapshot(newSnapshot)
+		return
+	}
+	if len(providers) == 0 {
+		pinnedConfVersion = 0
+	}
+	confFiles.commit()
+	checksum := confFiles.applied.checksum
+	if len(diff) == 0 && len(confHistory) > 0 && checksum == confHistory[len(confHistory)-1].checksum {
+		// 没有变化，不产生新的版本
+		return
 	}
+	commitSnapshot(newSnapshot, checksum, reason, diff)
 	return
 }
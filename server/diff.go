@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// rrsetDiff 是一个 RRset（名字、class 和 type 都相同的记录）的变化。
+// 修改TTL或者记录的内容会同时出现在 Removed 和 Added 中。
+type rrsetDiff struct {
+	Name    string   `json:"name"`
+	Class   string   `json:"class"`
+	Type    string   `json:"type"`
+	Source  string   `json:"source"` // RRset 的来源，删除的 RRset 为原来的来源
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// confDiff 是两次加载的配置之间的变化，按名字、class 和 type 排序
+type confDiff []rrsetDiff
+
+// counts 返回增加和删除的记录数量
+func (d confDiff) counts() (added, removed int) {
+	for _, rrset := range d {
+		added += len(rrset.Added)
+		removed += len(rrset.Removed)
+	}
+	return
+}
+
+// summary 返回变化的数量，用于日志和HTTP接口
+func (d confDiff) summary() string {
+	added, removed := d.counts()
+	return fmt.Sprintf("rrsets: %d, added: %d, removed: %d", len(d), added, removed)
+}
+
+// write 按 RRset 输出变化，增加的记录以 + 开头，删除的记录以 - 开头
+func (d confDiff) write(w io.Writer) {
+	fmt.Fprintf(w, "dns conf changes: %s\n", d.summary())
+	for _, rrset := range d {
+		fmt.Fprintf(w, "\t%s %s %s [%s]\n", rrset.Name, rrset.Class, rrset.Type, rrset.Source)
+		for _, rr := range rrset.Removed {
+			fmt.Fprintf(w, "\t\t- %s\n", rr)
+		}
+		for _, rr := range rrset.Added {
+			fmt.Fprintf(w, "\t\t+ %s\n", rr)
+		}
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// getDiffDNSConf 返回两个快照之间每个 RRset 增加和删除的记录
+func getDiffDNSConf(oldS, newS *rrSnapshot) (diff confDiff) {
+	oldC, newC := oldS.records, newS.records
+	type rrsetKey struct {
+		name string
+		t    [2]uint16
+	}
+	keys := map[rrsetKey]bool{}
+	for _, c := range []map[string]map[[2]uint16][]dns.RR{oldC, newC} {
+		for name, rrsAll := range c {
+			for t := range rrsAll {
+				keys[rrsetKey{name, t}] = true
+			}
+		}
+	}
+
+	for k := range keys {
+		added, removed := diffRRs(oldC[k.name][k.t], newC[k.name][k.t])
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		source := newS.sources[k.name][k.t]
+		if len(newC[k.name][k.t]) == 0 {
+			source = oldS.sources[k.name][k.t]
+		}
+		diff = append(diff, rrsetDiff{
+			Name:    k.name,
+			Class:   dns.Class(k.t[0]).String(),
+			Type:    dns.Type(k.t[1]).String(),
+			Source:  source,
+			Added:   added,
+			Removed: removed,
+		})
+	}
+
+	sort.Slice(diff, func(i, j int) bool {
+		if diff[i].Name != diff[j].Name {
+			return diff[i].Name < diff[j].Name
+		}
+		if diff[i].Class != diff[j].Class {
+			return diff[i].Class < diff[j].Class
+		}
+		return diff[i].Type < diff[j].Type
+	})
+	return
+}
+
+// diffRRs 比较同一个 RRset 新旧两份记录，返回增加和删除的记录，保持记录在配置中的顺序。
+// 相同的记录出现多次的时候按次数比较。
+func diffRRs(oldRRs, newRRs []dns.RR) (added, removed []string) {
+	remaining := map[string]int{}
+	for _, rr := range oldRRs {
+		remaining[rr.String()]++
+	}
+	for _, rr := range newRRs {
+		s := rr.String()
+		if remaining[s] > 0 {
+			remaining[s]--
+		} else {
+			added = append(added, s)
+		}
+	}
+	for _, rr := range oldRRs {
+		s := rr.String()
+		if remaining[s] > 0 {
+			remaining[s]--
+			removed = append(removed, s)
+		}
+	}
+	return
+}
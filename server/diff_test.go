@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDiffRRs(t *testing.T) {
+	rrs := func(lines ...string) []dns.RR {
+		var result []dns.RR
+		for _, line := range lines {
+			result = append(result, mustRR(t, line))
+		}
+		return result
+	}
+	tests := []struct {
+		desc           string
+		oldRRs, newRRs []dns.RR
+		added, removed []string
+	}{
+		{"unchanged", rrs("a.example. 60 IN A 10.0.0.1"), rrs("a.example. 60 IN A 10.0.0.1"), nil, nil},
+		{"added", rrs("a.example. 60 IN A 10.0.0.1"), rrs("a.example. 60 IN A 10.0.0.1", "a.example. 60 IN A 10.0.0.2"),
+			[]string{"a.example.\t60\tIN\tA\t10.0.0.2"}, nil},
+		{"removed", rrs("a.example. 60 IN A 10.0.0.1", "a.example. 60 IN A 10.0.0.2"), rrs("a.example. 60 IN A 10.0.0.2"),
+			nil, []string{"a.example.\t60\tIN\tA\t10.0.0.1"}},
+		{"ttl changed", rrs("a.example. 60 IN A 10.0.0.1"), rrs("a.example. 120 IN A 10.0.0.1"),
+			[]string{"a.example.\t120\tIN\tA\t10.0.0.1"}, []string{"a.example.\t60\tIN\tA\t10.0.0.1"}},
+		{"duplicate removed", rrs("a.example. 60 IN A 10.0.0.1", "a.example. 60 IN A 10.0.0.1"), rrs("a.example. 60 IN A 10.0.0.1"),
+			nil, []string{"a.example.\t60\tIN\tA\t10.0.0.1"}},
+		{"order ignored", rrs("a.example. 60 IN A 10.0.0.1", "a.example. 60 IN A 10.0.0.2"), rrs("a.example. 60 IN A 10.0.0.2", "a.example. 60 IN A 10.0.0.1"), nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			added, removed := diffRRs(tt.oldRRs, tt.newRRs)
+			if fmt.Sprint(added) != fmt.Sprint(tt.added) || fmt.Sprint(removed) != fmt.Sprint(tt.removed) {
+				t.Errorf("diffRRs() = added %q, removed %q, want added %q, removed %q", added, removed, tt.added, tt.removed)
+			}
+		})
+	}
+}
+
+// TestDiffDNSConfPerRRset 删除一个名字的 AAAA 记录的时候，同一个名字的 A 记录不算变化
+func TestDiffDNSConfPerRRset(t *testing.T) {
+	oldS := testSnapshot(t,
+		"h.test. 3600 IN A 1.1.1.1",
+		"h.test. 3600 IN AAAA ::1",
+		"h.test. 3600 IN AAAA ::2",
+		"old.test. 3600 IN TXT \"x\"",
+	)
+	newS := testSnapshot(t,
+		"h.test. 3600 IN A 1.1.1.1",
+		"h.test. 3600 IN AAAA ::2",
+		"new.test. 3600 IN TXT \"y\"",
+	)
+	var got []string
+	for _, rrset := range getDiffDNSConf(oldS, newS) {
+		got = append(got, fmt.Sprintf("%s %s %s +%q -%q", rrset.Name, rrset.Class, rrset.Type, rrset.Added, rrset.Removed))
+	}
+	want := []string{
+		`h.test. IN AAAA +[] -["h.test.\t3600\tIN\tAAAA\t::1"]`,
+		`new.test. IN TXT +["new.test.\t3600\tIN\tTXT\t\"y\""] -[]`,
+		`old.test. IN TXT +[] -["old.test.\t3600\tIN\tTXT\t\"x\""]`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diff =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestReloadConfJSON(t *testing.T) {
+	dir := setupTestConf(t, map[string]string{
+		"test.dns-conf": "h.test. 3600 IN A 1.1.1.1\nh.test. 3600 IN AAAA ::1\nh.test. 3600 IN AAAA ::2\n",
+		"resolv.conf":   "nameserver 192.0.2.1\n",
+	})
+	defer setNameservers()
+	setNameservers("192.0.2.1", "192.0.2.2")
+	writeTestFiles(t, dir, map[string]string{
+		"test.dns-conf": "h.test. 3600 IN A 1.1.1.2\n",
+	})
+
+	req := httptest.NewRequest("GET", "/reload_conf", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	reloadConfHandler(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type = %q, want application/json", ct)
+	}
+	want := fmt.Sprintf(`{"dry_run":false,"applied":true,"added":1,"removed":3,"changes":[`+
+		`{"name":"h.test.","class":"IN","type":"A","source":%[1]q,"added":["h.test.\t3600\tIN\tA\t1.1.1.2"],"removed":["h.test.\t3600\tIN\tA\t1.1.1.1"]},`+
+		`{"name":"h.test.","class":"IN","type":"AAAA","source":%[1]q,"removed":["h.test.\t3600\tIN\tAAAA\t::1","h.test.\t3600\tIN\tAAAA\t::2"]}],`+
+		`"nameservers_added":[],"nameservers_removed":["192.0.2.2:53"]}`+"\n", dir)
+	if got := w.Body.String(); got != want {
+		t.Errorf("response =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dockerDomain 是容器记录所在的域名，容器的记录为 <容器名>.<网络名>.docker.
+	dockerDomain = "docker."
+	// dockerNamesLabel 是容器的 label，值为逗号分隔的额外域名，解析到容器所有网络的IP
+	dockerNamesLabel = "fpdns.names"
+	// dockerTTL 是容器生成的记录使用的 TTL
+	dockerTTL = 30
+	// 请求容器列表的超时时间
+	dockerRequestTimeout = 10 * time.Second
+)
+
+// 事件流断开之后重新连接的间隔，测试中会改短
+var dockerRetryInterval = 5 * time.Second
+
+// dockerProvider 通过 unix socket 上的 Docker Engine API 发现运行中的容器，
+// 为每个容器生成 <容器名>.<网络名>.docker. 的 A 记录，以及 fpdns.names label 中的域名的记录。
+// 收到容器启动、停止等事件的时候重新获取容器列表，用 MemoryProvider 替换所有的记录。
+type dockerProvider struct {
+	*MemoryProvider
+	socket string
+	client *http.Client
+
+	mu sync.Mutex
+	// 最后一次获取到的运行中的容器的数量
+	containers int
+	// 最后一次获取容器列表或者事件流的错误，成功的时候为 nil
+	err error
+}
+
+// dockerContainer 是 /containers/json 返回的容器中用到的字段
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerEvent 是 /events 返回的事件中用到的字段
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+}
+
+// dockerSource 是 Docker 的 Provider，没有指定 socket 的时候为 nil
+var dockerSource *dockerProvider
+
+// initDockerProvider 注册 Docker 的 Provider，第一次获取容器列表之后在后台监听容器事件
+func initDockerProvider(socket string) {
+	if socket == "" {
+		return
+	}
+	dockerSource = newDockerProvider(socket)
+	RegisterProvider(dockerSource)
+	if err := dockerSource.sync(); err != nil {
+		logInstance.Errorf("list docker containers from [%s] error: %s\n", socket, err)
+	}
+	go dockerSource.run()
+}
+
+func newDockerProvider(socket string) *dockerProvider {
+	return &dockerProvider{
+		MemoryProvider: NewMemoryProvider("docker"),
+		socket:         socket,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// run 监听容器事件，事件流断开之后重新获取容器列表并重新连接
+func (p *dockerProvider) run() {
+	for {
+		err := p.watchEvents()
+		p.setStatus(-1, err)
+		logInstance.Warnf("docker events from [%s] error: %s, retry in %s\n", p.socket, err, dockerRetryInterval)
+		time.Sleep(dockerRetryInterval)
+		if err := p.sync(); err != nil {
+			logInstance.Warnf("list docker containers from [%s] error: %s\n", p.socket, err)
+		}
+	}
+}
+
+// watchEvents 读取容器和网络的事件流，容器启动、停止、改名或者连接到其他网络的时候重新获取容器列表。
+// 只在出现错误的时候返回。
+func (p *dockerProvider) watchEvents() error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container", "network"},
+		"event": {"start", "die", "destroy", "rename", "connect", "disconnect"},
+	})
+	resp, err := p.client.Get("http://docker/events?filters=" + url.QueryEscape(string(filters)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event dockerEvent
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		logInstance.Debugf("docker event: %s %s\n", event.Type, event.Action)
+		if err := p.sync(); err != nil {
+			return err
+		}
+	}
+}
+
+// sync 获取运行中的容器，用生成的记录替换原来的记录
+func (p *dockerProvider) sync() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://docker/containers/json", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.setStatus(-1, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected status: %s", resp.Status)
+		p.setStatus(-1, err)
+		return err
+	}
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		p.setStatus(-1, err)
+		return err
+	}
+
+	rrs, errs := dockerRecords(containers)
+	p.Replace(rrs, errs)
+	p.setStatus(len(containers), nil)
+	return nil
+}
+
+// setStatus 记录容器数量和错误，containers 为负数的时候不修改容器数量
+func (p *dockerProvider) setStatus(containers int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if containers >= 0 {
+		p.containers = containers
+	}
+	p.err = err
+}
+
+// status 返回最后一次获取到的容器数量和最后一次的错误
+func (p *dockerProvider) status() (containers int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.containers, p.err
+}
+
+// dockerRecords 为容器生成记录，同一个域名的多个容器的记录合并为一个 RRset，用于负载均衡
+func dockerRecords(containers []dockerContainer) (rrs []dns.RR, errs []error) {
+	for _, c := range containers {
+		if len(c.Names) == 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(c.Names[0], "/"))
+
+		var ips []net.IP
+		for network, settings := range c.NetworkSettings.Networks {
+			var netIPs []net.IP
+			for _, s := range []string{settings.IPAddress, settings.GlobalIPv6Address} {
+				if ip := net.ParseIP(s); ip != nil {
+					netIPs = append(netIPs, ip)
+				}
+			}
+			ips = append(ips, netIPs...)
+
+			fqdn := name + "." + strings.ToLower(network) + "." + dockerDomain
+			if _, ok := dns.IsDomainName(fqdn); !ok {
+				errs = append(errs, fmt.Errorf("docker container [%s]: bad domain name %q", name, fqdn))
+				continue
+			}
+			for _, ip := range netIPs {
+				rrs = append(rrs, newAddrRR(fqdn, ip, dockerTTL))
+			}
+		}
+
+		for _, label := range strings.Split(c.Labels[dockerNamesLabel], ",") {
+			if label = strings.TrimSpace(label); label == "" {
+				continue
+			}
+			if _, ok := dns.IsDomainName(label); !ok {
+				errs = append(errs, fmt.Errorf("docker container [%s]: bad domain name %q in label %s", name, label, dockerNamesLabel))
+				continue
+			}
+			for _, ip := range ips {
+				rrs = append(rrs, newAddrRR(normalizeName(label), ip, dockerTTL))
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDocker 是监听在 unix socket 上的 Docker Engine API，只实现了 /containers/json 和 /events
+type fakeDocker struct {
+	socket string
+	server *http.Server
+
+	mu         sync.Mutex
+	containers []dockerContainer
+
+	events chan dockerEvent
+	// 关闭当前的事件流
+	closeEvents chan struct{}
+	// 事件流连接的次数
+	connects int32
+}
+
+func newFakeDocker(t *testing.T) *fakeDocker {
+	t.Helper()
+	d := &fakeDocker{
+		socket:      filepath.Join(t.TempDir(), "docker.sock"),
+		events:      make(chan dockerEvent),
+		closeEvents: make(chan struct{}),
+	}
+	l, err := net.Listen("unix", d.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.containers)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&d.connects, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-d.events:
+				json.NewEncoder(w).Encode(event)
+				w.(http.Flusher).Flush()
+			case <-d.closeEvents:
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	d.server = &http.Server{Handler: mux}
+	go d.server.Serve(l)
+	t.Cleanup(func() { d.server.Close() })
+	return d
+}
+
+func (d *fakeDocker) setContainers(containers ...dockerContainer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.containers = containers
+}
+
+// testContainer 创建一个容器，networks 为网络名和IP，IPv6 地址用 "IPv4,IPv6" 的格式
+func testContainer(name string, labels map[string]string, networks map[string]string) dockerContainer {
+	c := dockerContainer{ID: name + "-id", Names: []string{"/" + name}, Labels: labels}
+	c.NetworkSettings.Networks = map[string]struct {
+		IPAddress         string `json:"IPAddress"`
+		GlobalIPv6Address string `json:"GlobalIPv6Address"`
+	}{}
+	for network, ips := range networks {
+		settings := c.NetworkSettings.Networks[network]
+		parts := strings.SplitN(ips, ",", 2)
+		settings.IPAddress = parts[0]
+		if len(parts) > 1 {
+			settings.GlobalIPv6Address = parts[1]
+		}
+		c.NetworkSettings.Networks[network] = settings
+	}
+	return c
+}
+
+// dockerAnswers 返回 p 中 name 的所有记录的值，排好序
+func dockerAnswers(p *dockerProvider, name string) []string {
+	rrsets, _ := p.Load()
+	var values []string
+	for _, rrset := range rrsets {
+		if rrset.Name != name {
+			continue
+		}
+		for _, rr := range rrset.RRs {
+			fields := strings.Fields(rr.String())
+			values = append(values, fields[len(fields)-1])
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+func TestDockerRecords(t *testing.T) {
+	d := newFakeDocker(t)
+	d.setContainers(
+		testContainer("Web", map[string]string{dockerNamesLabel: "web.example.com, www.example.com"},
+			map[string]string{"bridge": "172.17.0.2", "App": "10.1.0.5,fd00::5"}),
+		testContainer("db", map[string]string{dockerNamesLabel: "db..example.com"},
+			map[string]string{"bridge": "172.17.0.3"}),
+		testContainer("no-ip", nil, map[string]string{"none": ""}),
+	)
+	p := newDockerProvider(d.socket)
+	if err := p.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		values []string
+	}{
+		{"web.bridge.docker.", []string{"172.17.0.2"}},
+		{"web.app.docker.", []string{"10.1.0.5", "fd00::5"}},
+		{"web.example.com.", []string{"10.1.0.5", "172.17.0.2", "fd00::5"}},
+		{"www.example.com.", []string{"10.1.0.5", "172.17.0.2", "fd00::5"}},
+		{"db.bridge.docker.", []string{"172.17.0.3"}},
+		{"no-ip.none.docker.", nil},
+	}
+	for _, tt := range tests {
+		if got := dockerAnswers(p, tt.name); fmt.Sprint(got) != fmt.Sprint(tt.values) {
+			t.Errorf("%s = %v, want %v", tt.name, got, tt.values)
+		}
+	}
+
+	// 不合法的 label 只产生错误，其他记录照常生成
+	_, errs := p.Load()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "db..example.com") {
+		t.Errorf("errors = %v, want an error for the bad label", errs)
+	}
+	if containers, err := p.status(); containers != 3 || err != nil {
+		t.Errorf("status = %d, %v, want 3 containers and no error", containers, err)
+	}
+}
+
+// waitFor 等待 cond 返回 true，超时的时候测试失败
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDockerEventsReconnect(t *testing.T) {
+	d := newFakeDocker(t)
+	d.setContainers(testContainer("web", nil, map[string]string{"bridge": "172.17.0.2"}))
+	p := newDockerProvider(d.socket)
+	if err := p.sync(); err != nil {
+		t.Fatal(err)
+	}
+	go p.run()
+	waitFor(t, "events stream", func() bool { return atomic.LoadInt32(&d.connects) == 1 })
+
+	// 收到事件之后重新获取容器列表
+	d.setContainers(
+		testContainer("web", nil, map[string]string{"bridge": "172.17.0.2"}),
+		testContainer("api", map[string]string{dockerNamesLabel: "bad..name"}, map[string]string{"bridge": "172.17.0.4"}),
+	)
+	d.events <- dockerEvent{Type: "container", Action: "start"}
+	waitFor(t, "api container", func() bool { return len(dockerAnswers(p, "api.bridge.docker.")) == 1 })
+
+	// 事件流断开之后重新连接，并重新获取断开期间变化的容器列表
+	d.setContainers(testContainer("api", nil, map[string]string{"bridge": "172.17.0.4"}))
+	d.closeEvents <- struct{}{}
+	waitFor(t, "reconnect", func() bool { return atomic.LoadInt32(&d.connects) == 2 })
+	waitFor(t, "web container removed", func() bool { return len(dockerAnswers(p, "web.bridge.docker.")) == 0 })
+
+	d.setContainers()
+	d.events <- dockerEvent{Type: "container", Action: "die"}
+	waitFor(t, "api container removed", func() bool { return len(dockerAnswers(p, "api.bridge.docker.")) == 0 })
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// confVersion 是一个加载过的本地配置版本
+type confVersion struct {
+	version  int
+	loadedAt time.Time
+	// 加载的记录文件的 sha256，回滚的时候为回滚到的版本的 checksum
+	checksum string
+	// 产生这个版本的原因，例如 reload、rollback to 3
+	reason string
+	// 和上一个版本相比的变化
+	diff confDiff
+
+	snapshot *rrSnapshot
+	// 这个版本的配置文件的 RRset，回滚的时候和其他 Provider 当前的记录重新合并
+	files []RRset
+}
+
+var (
+	// 最近加载的配置版本，按版本号从小到大排列，最后一个是当前使用的版本，修改的时候需要持有 reloadLock
+	confHistory     []*confVersion
+	lastConfVersion int
+	// 回滚之后配置文件固定在回滚到的版本，为0表示没有固定。固定的时候配置目录和远程配置的变化不会自动加载，
+	// 直到 /reload_conf 或者 SIGHUP 重新加载所有的来源，修改的时候需要持有 reloadLock
+	pinnedConfVersion int
+)
+
+// defaultConfHistory 是 ServerConfig.ConfHistory 没有设置的时候保留的版本数量
+const defaultConfHistory = 10
+
+// commitSnapshot 把 s 替换为当前使用的快照，并记录到配置历史中，调用的时候需要持有 reloadLock。
+// 需要先用 saveProviderRRsets 保存配置文件的记录，和版本一起保存用于回滚。
+func commitSnapshot(s *rrSnapshot, checksum, reason string, diff confDiff) *confVersion {
+	lastConfVersion++
+	v := &confVersion{
+		version:  lastConfVersion,
+		loadedAt: time.Now(),
+		checksum: checksum,
+		reason:   reason,
+		diff:     diff,
+		snapshot: s,
+		files:    providerRRsets[confFiles.Name()],
+	}
+
+	size := sc.ConfHistory
+	if size <= 0 {
+		size = defaultConfHistory
+	}
+	confHistory = append(confHistory, v)
+	if len(confHistory) > size {
+		confHistory = append([]*confVersion(nil), confHistory[len(confHistory)-size:]...)
+	}
+	storeRRSnapshot(s)
+	return v
+}
+
+// listConfVersions 返回配置历史的副本，以及配置文件固定在的版本，没有固定的时候为0
+func listConfVersions() (versions []*confVersion, pinned int) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	return append([]*confVersion(nil), confHistory...), pinnedConfVersion
+}
+
+// findConfVersion 在配置历史中查找版本，不存在或者已经被丢弃的时候返回 nil，调用的时候需要持有 reloadLock
+func findConfVersion(version int) *confVersion {
+	for _, v := range confHistory {
+		if v.version == version {
+			return v
+		}
+	}
+	return nil
+}
+
+// getConfVersion 返回配置历史中的版本
+func getConfVersion(version int) *confVersion {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	return findConfVersion(version)
+}
+
+// rollbackConf 把配置文件的记录回滚到历史中的版本，和其他 Provider 当前的记录重新合并，不会修改配置目录中的文件。
+// 回滚会产生一个新的版本，并把配置文件固定在回滚到的版本：配置目录和远程配置的变化不会自动加载，
+// 租约文件等其他 Provider 的变化仍然会加载，直到 /reload_conf 或者 SIGHUP 重新加载所有的来源。
+func rollbackConf(version int) (*confVersion, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	target := findConfVersion(version)
+	if target == nil {
+		return nil, fmt.Errorf("conf version %d not found", version)
+	}
+	providerRRsets[confFiles.Name()] = target.files
+	s := mergeProviderRRsets(providerRRsets)
+	diff := getDiffDNSConf(currentRRSnapshot(), s)
+	pinnedConfVersion = version
+	return commitSnapshot(s, target.checksum, fmt.Sprintf("rollback to %d", version), diff), nil
+}
+
+// checksum 返回加载的记录文件的路径和内容的 sha256
+func (l *confLoader) checksum() string {
+	return hex.EncodeToString(l.sum.Sum(nil))
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answerA 返回 name 的第一条 A 记录的IP，没有的时候返回空字符串
+func answerA(t *testing.T, name string) string {
+	t.Helper()
+	m := testQuery(t, name, dns.TypeA)
+	if len(m.Answer) == 0 {
+		return ""
+	}
+	return m.Answer[0].(*dns.A).A.String()
+}
+
+func TestRollbackSurvivesProviderNotification(t *testing.T) {
+	dir := setupTestConf(t, map[string]string{"test.dns-conf": "a.example. IN A 10.0.0.1\n"})
+	leases := NewMemoryProvider("leases")
+	RegisterProvider(leases)
+
+	writeTestFiles(t, dir, map[string]string{"test.dns-conf": "a.example. IN A 10.0.0.2\n"})
+	if _, _, err := reloadDNSConf("/reload_conf", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rollbackConf(1); err != nil {
+		t.Fatal(err)
+	}
+	if got := answerA(t, "a.example."); got != "10.0.0.1" {
+		t.Fatalf("a.example. after rollback = %q, want 10.0.0.1", got)
+	}
+	versions, _ := listConfVersions()
+
+	// 其他 Provider 的变化会加载，但是不会覆盖回滚，也不产生新的版本
+	leases.Add(mustRR(t, "host.lan. IN A 192.168.1.10"))
+	if _, _, err := reloadDNSConf("leases changed", false, leases); err != nil {
+		t.Fatal(err)
+	}
+	if got := answerA(t, "host.lan."); got != "192.168.1.10" {
+		t.Errorf("host.lan. = %q, want the lease record", got)
+	}
+	if got := answerA(t, "a.example."); got != "10.0.0.1" {
+		t.Errorf("a.example. after provider notification = %q, want the rolled back 10.0.0.1", got)
+	}
+
+	// 配置文件的变化通知被忽略
+	if _, _, err := reloadDNSConf("conf dir changed", false, confFiles); err != nil {
+		t.Fatal(err)
+	}
+	if got := answerA(t, "a.example."); got != "10.0.0.1" {
+		t.Errorf("a.example. after conf dir change = %q, want the rolled back 10.0.0.1", got)
+	}
+	if got, pinned := listConfVersions(); len(got) != len(versions) || pinned != 1 {
+		t.Errorf("history has %d versions pinned to %d, want %d versions pinned to 1", len(got), pinned, len(versions))
+	}
+
+	w := httptest.NewRecorder()
+	confHistoryHandler(w, httptest.NewRequest("GET", "/conf_history", nil))
+	if !strings.Contains(w.Body.String(), "pinned to version 1") {
+		t.Errorf("/conf_history does not show the pinned version:\n%s", w.Body.String())
+	}
+
+	// 重新加载所有的来源之后取消固定
+	if _, _, err := reloadDNSConf("/reload_conf", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := answerA(t, "a.example."); got != "10.0.0.2" {
+		t.Errorf("a.example. after /reload_conf = %q, want 10.0.0.2", got)
+	}
+	if got := answerA(t, "host.lan."); got != "192.168.1.10" {
+		t.Errorf("host.lan. after /reload_conf = %q, want the lease record", got)
+	}
+	if _, pinned := listConfVersions(); pinned != 0 {
+		t.Errorf("conf files are still pinned to %d after /reload_conf", pinned)
+	}
+}
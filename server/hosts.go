@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// hostsTTL 是 hosts 文件生成的记录使用的 TTL
+const hostsTTL = 600
+
+// parseHostsFile 解析 /etc/hosts 格式的文件，每一行的格式为 "IP 域名 别名..."，# 后面的内容为注释。
+// 每个域名都会生成 A 或 AAAA 记录，每个IP生成一条指向第一个域名的 PTR 记录，
+// 同一个IP出现在多行的时候，使用第一次出现的那一行。r 为文件 path 的内容。
+func parseHostsFile(path string, r io.Reader) (rrs []dns.RR, errs []error) {
+	seen := map[string]bool{}
+	lineNo := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			errs = append(errs, fmt.Errorf("%s: missing host name at line: %d", path, lineNo))
+			continue
+		}
+
+		// 去掉 IPv6 地址的 zone，例如 fe80::1%lo0
+		addr := fields[0]
+		if i := strings.IndexByte(addr, '%'); i >= 0 {
+			addr = addr[:i]
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			errs = append(errs, fmt.Errorf("%s: bad IP address %q at line: %d", path, fields[0], lineNo))
+			continue
+		}
+
+		var names []string
+		for _, host := range fields[1:] {
+			name := strings.ToLower(dns.Fqdn(host))
+			if _, ok := dns.IsDomainName(name); !ok {
+				errs = append(errs, fmt.Errorf("%s: bad host name %q at line: %d", path, host, lineNo))
+				continue
+			}
+			names = append(names, name)
+		}
+
+		for _, name := range names {
+			key := name + " " + ip.String()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			rrs = append(rrs, newAddrRR(name, ip, hostsTTL))
+		}
+
+		if len(names) > 0 && !seen[ip.String()] {
+			seen[ip.String()] = true
+			reverse, _ := dns.ReverseAddr(ip.String())
+			rrs = append(rrs, &dns.PTR{
+				Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: hostsTTL},
+				Ptr: names[0],
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %s", path, err))
+	}
+	return
+}
+
+// newAddrRR 根据IP的类型创建 A 或者 AAAA 记录
+func newAddrRR(name string, ip net.IP, ttl uint32) dns.RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   ip4,
+		}
+	}
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+		AAAA: ip,
+	}
+}
+
+// loadHostsFile 加载 hosts 文件中的记录
+func (l *confLoader) loadHostsFile(path string) {
+	if data, ok := l.readFile(path); ok {
+		l.addHosts(path, data)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseHostsFile(t *testing.T) {
+	hosts := strings.Join([]string{
+		"# comment line", // 1
+		"10.0.0.1  web.test  www.test  WWW2.test # x", // 2
+		"",                                    // 3
+		"fe80::1%lo0  v6.test",                // 4
+		"2001:db8::1  v6.test  dual.test",     // 5
+		"10.0.0.300  bad.test",                // 6 bad
+		"10.0.0.2",                            // 7 bad
+		"10.0.0.1  other.test",                // 8
+		"10.0.0.3  dual.test  bad_name..test", // 9 bad name
+		"  10.0.0.4\tindented.test",           // 10
+	}, "\n")
+	rrs, errs := parseHostsFile("test.hosts", strings.NewReader(hosts))
+
+	wantErrs := []string{
+		`test.hosts: bad IP address "10.0.0.300" at line: 6`,
+		`test.hosts: missing host name at line: 7`,
+		`test.hosts: bad host name "bad_name..test" at line: 9`,
+	}
+	var gotErrs []string
+	for _, err := range errs {
+		gotErrs = append(gotErrs, err.Error())
+	}
+	if strings.Join(gotErrs, "\n") != strings.Join(wantErrs, "\n") {
+		t.Errorf("errors =\n%s\nwant\n%s", strings.Join(gotErrs, "\n"), strings.Join(wantErrs, "\n"))
+	}
+
+	want := []string{
+		"web.test.\t600\tIN\tA\t10.0.0.1",
+		"www.test.\t600\tIN\tA\t10.0.0.1",
+		"www2.test.\t600\tIN\tA\t10.0.0.1",
+		"1.0.0.10.in-addr.arpa.\t600\tIN\tPTR\tweb.test.",
+		"v6.test.\t600\tIN\tAAAA\tfe80::1",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa.\t600\tIN\tPTR\tv6.test.",
+		"v6.test.\t600\tIN\tAAAA\t2001:db8::1",
+		"dual.test.\t600\tIN\tAAAA\t2001:db8::1",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.\t600\tIN\tPTR\tv6.test.",
+		// 同一个IP出现在多行的时候只有第一行生成 PTR 记录
+		"other.test.\t600\tIN\tA\t10.0.0.1",
+		"dual.test.\t600\tIN\tA\t10.0.0.3",
+		"3.0.0.10.in-addr.arpa.\t600\tIN\tPTR\tdual.test.",
+		"indented.test.\t600\tIN\tA\t10.0.0.4",
+		"4.0.0.10.in-addr.arpa.\t600\tIN\tPTR\tindented.test.",
+	}
+	var got []string
+	for _, rr := range rrs {
+		got = append(got, rr.String())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("records =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestHostsFilePrecedence -hosts_file 属于 -conf_dir 来源，和其中的 .dns-conf 的记录合并，
+// 优先于 -extra_conf_dirs 中的记录
+func TestHostsFilePrecedence(t *testing.T) {
+	confDir, hostsDir, extraDir := t.TempDir(), t.TempDir(), t.TempDir()
+	writeTestFiles(t, confDir, map[string]string{
+		"test.dns-conf": "h.test. 60 IN A 10.0.0.1\nh.test. 60 IN TXT \"conf\"\n",
+	})
+	writeTestFiles(t, hostsDir, map[string]string{"hosts": "10.0.0.2 h.test\n"})
+	writeTestFiles(t, extraDir, map[string]string{
+		"extra.hosts":    "10.0.0.3 h.test\n10.0.0.4 e.test\n",
+		"extra.dns-conf": "e.test. 60 IN TXT \"extra\"\n",
+	})
+
+	l := newConfLoader(ServerConfig{ConfDir: confDir, HostsFile: filepath.Join(hostsDir, "hosts"), ExtraConfDirs: []string{extraDir}})
+	l.loadSources()
+	records, sources := l.finish()
+	if len(l.errs) > 0 {
+		t.Fatal(l.errs)
+	}
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		want   []string
+		source string
+	}{
+		{"h.test.", dns.TypeA, []string{"h.test.\t60\tIN\tA\t10.0.0.1", "h.test.\t600\tIN\tA\t10.0.0.2"}, confDir},
+		{"h.test.", dns.TypeTXT, []string{"h.test.\t60\tIN\tTXT\t\"conf\""}, confDir},
+		{"e.test.", dns.TypeA, []string{"e.test.\t600\tIN\tA\t10.0.0.4"}, extraDir},
+		{"e.test.", dns.TypeTXT, []string{"e.test.\t60\tIN\tTXT\t\"extra\""}, extraDir},
+		{"2.0.0.10.in-addr.arpa.", dns.TypePTR, []string{"2.0.0.10.in-addr.arpa.\t600\tIN\tPTR\th.test."}, confDir},
+		{"3.0.0.10.in-addr.arpa.", dns.TypePTR, []string{"3.0.0.10.in-addr.arpa.\t600\tIN\tPTR\th.test."}, extraDir},
+	}
+	for _, tt := range tests {
+		key := [2]uint16{dns.ClassINET, tt.qtype}
+		var got []string
+		for _, rr := range records[tt.name][key] {
+			got = append(got, rr.String())
+		}
+		sort.Strings(got)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s %s =\n%s\nwant\n%s", tt.name, dns.TypeToString[tt.qtype], strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+		if source := sources[tt.name][key]; source != tt.source {
+			t.Errorf("%s %s source = %s, want %s", tt.name, dns.TypeToString[tt.qtype], source, tt.source)
+		}
+	}
+}
@@ -1,63 +1,284 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/miekg/dns"
+
 	"fpdns/lib"
 )
 
 // InitHTTP 初始化HTTP服务
-func InitHTTP(addr string) {
+func InitHTTP(srv *http.Server) {
 	http.HandleFunc("/debug", debugHandler)
 
 	http.HandleFunc("/reload_conf", reloadConfHandler)
 
-	lib.AppLog().Debugln("start http server at ", addr)
-	err := http.ListenAndServe(addr, nil)
-	if err != nil {
+	http.HandleFunc("/conf_history", confHistoryHandler)
+	http.HandleFunc("/conf_history/show", confVersionHandler)
+	http.HandleFunc("/conf_history/rollback", rollbackConfHandler)
+
+	lib.AppLog().Debugln("start http server at ", srv.Addr)
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		lib.AppLog().Errorln("start http failed: ", err)
 	}
 }
 
 func debugHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Local config cache len:%d\n", len(rrCache))
-	// for k, v := range rrCache {
-	// 	fmt.Fprintf(w, "\t[class:%s, type:%s]: %d\n",
-	// 		dns.ClassToString[k[0]], dns.TypeToString[k[1]], len(v))
-	// }
+	snapshot := currentRRSnapshot()
+	fmt.Fprintf(w, "Local config cache len:%d\n", len(snapshot.records))
+	counts := snapshot.countByType()
+	types := make([][2]uint16, 0, len(counts))
+	for k := range counts {
+		types = append(types, k)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i][0] < types[j][0] || (types[i][0] == types[j][0] && types[i][1] < types[j][1])
+	})
+	for _, k := range types {
+		fmt.Fprintf(w, "\t[class:%s, type:%s]: %d\n",
+			dns.ClassToString[k[0]], dns.TypeToString[k[1]], counts[k])
+	}
+
+	fmt.Fprintf(w, "\nLocal config sources:\n")
+	sourceCounts := snapshot.countBySource()
+	for _, dir := range append([]string{sc.ConfDir}, sc.ExtraConfDirs...) {
+		fmt.Fprintf(w, "\t[%s]: %d\n", dir, sourceCounts[dir])
+		delete(sourceCounts, dir)
+	}
+	for _, r := range remoteConfs {
+		data, fetchedAt, err := r.status()
+		fmt.Fprintf(w, "\t[%s]: %d", r.label, sourceCounts[r.label])
+		delete(sourceCounts, r.label)
+		if data != nil {
+			fmt.Fprintf(w, ", fetched at %s", fetchedAt.Format("2006-01-02 15:04:05"))
+		}
+		if err != nil {
+			fmt.Fprintf(w, ", last fetch error: %s", err)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	for _, p := range leaseProviders {
+		fmt.Fprintf(w, "\t[%s]: %d, active leases: %d\n", p.Name(), sourceCounts[p.Name()], p.activeLeases())
+		delete(sourceCounts, p.Name())
+	}
+	if dockerSource != nil {
+		containers, err := dockerSource.status()
+		fmt.Fprintf(w, "\t[%s]: %d, containers: %d", dockerSource.Name(), sourceCounts[dockerSource.Name()], containers)
+		delete(sourceCounts, dockerSource.Name())
+		if err != nil {
+			fmt.Fprintf(w, ", last error: %s", err)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	// 其他 Provider 的记录
+	others := make([]string, 0, len(sourceCounts))
+	for label := range sourceCounts {
+		others = append(others, label)
+	}
+	sort.Strings(others)
+	for _, label := range others {
+		fmt.Fprintf(w, "\t[%s]: %d\n", label, sourceCounts[label])
+	}
+
+	if len(snapshot.conflicts) > 0 {
+		fmt.Fprintf(w, "\nLocal config conflicts: %d\n", len(snapshot.conflicts))
+		for _, conflict := range snapshot.conflicts {
+			fmt.Fprintf(w, "\t%s\n", conflict)
+		}
+	}
 
 	fmt.Fprintf(w, "\nResolved cache len: %d\n", resolvCache.Length())
+	fmt.Fprintf(w, "\thits: %d, misses: %d\n", atomic.LoadInt64(&cacheHits), atomic.LoadInt64(&cacheMisses))
+	fmt.Fprintf(w, "\tnegative hits: %d, negative misses: %d\n", atomic.LoadInt64(&negativeCacheHits), atomic.LoadInt64(&negativeCacheMisses))
+	fmt.Fprintf(w, "\tstale answers served: %d\n", atomic.LoadInt64(&staleAnswers))
+	fmt.Fprintf(w, "\tprefetches: %d\n", atomic.LoadInt64(&prefetches))
+	fmt.Fprintf(w, "\tcoalesced lookups: %d\n", atomic.LoadInt64(&coalescedLookups))
 	fmt.Fprintf(w, "\n\nDNS Query QPS: %f\n", currentQPS)
 
 	fmt.Fprintf(w, "\n\nDNS Nameservers Ping: \n")
-	for k, v := range nameserverPingStatus {
+	for k, v := range pingStatusSnapshot() {
 		fmt.Fprintf(w, "\t%s: \n", k)
-		if v[0] != nil {
+		if v != nil {
 			fmt.Fprintf(w, "\t\t [%s]: send:%d, recv:%d, loss:%.1f, avgRtt:%dms \n",
-				v[0].PingAt.Format("2006-01-02 15:04:05"),
-				v[0].Statistics.PacketsSent,
-				v[0].Statistics.PacketsRecv,
-				v[0].Statistics.PacketLoss,
-				v[0].Statistics.AvgRtt/time.Millisecond)
+				v.PingAt.Format("2006-01-02 15:04:05"),
+				v.Statistics.PacketsSent,
+				v.Statistics.PacketsRecv,
+				v.Statistics.PacketLoss,
+				v.Statistics.AvgRtt/time.Millisecond)
 		}
 	}
 }
 
+// reloadResponse 是 /reload_conf 的 JSON 响应
+type reloadResponse struct {
+	DryRun  bool     `json:"dry_run"`
+	Applied bool     `json:"applied"`
+	Added   int      `json:"added"`
+	Removed int      `json:"removed"`
+	Changes confDiff `json:"changes"`
+	Errors  []string `json:"errors,omitempty"`
+
+	NameserversAdded   []string `json:"nameservers_added"`
+	NameserversRemoved []string `json:"nameservers_removed"`
+	ResolvConfError    string   `json:"resolv_conf_error,omitempty"`
+}
+
+// reloadConfHandler 重新加载dns配置和 resolv.conf，dry_run=1 的时候只返回变化，不替换正在使用的配置。
+// 响应中包含加载过程中出现的错误，严格模式下加载出错的时候不会重新加载 resolv.conf。
+// 严格模式下加载出错或者 resolv.conf 读取失败的时候返回 422。
+// 请求头 Accept 包含 application/json 的时候返回 JSON。
 func reloadConfHandler(w http.ResponseWriter, r *http.Request) {
-	add, del, change := reloadDNSConf()
-	fmt.Fprintf(w, "reload dns conf done.\n\n")
+	dryRun, _ := strconv.ParseBool(r.FormValue("dry_run"))
+	diff, errs, err := reloadDNSConf("/reload_conf", dryRun)
+	var addNS, delNS []string
+	var nsErr error
+	if err == nil {
+		addNS, delNS, nsErr = reloadResolver(dryRun)
+	}
+
+	status := http.StatusOK
+	if err != nil || nsErr != nil {
+		status = http.StatusUnprocessableEntity
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		resp := reloadResponse{
+			DryRun:             dryRun,
+			Applied:            err == nil && !dryRun,
+			Changes:            confDiff{},
+			NameserversAdded:   []string{},
+			NameserversRemoved: []string{},
+		}
+		if diff != nil {
+			resp.Changes = diff
+		}
+		resp.Added, resp.Removed = diff.counts()
+		for _, e := range errs {
+			resp.Errors = append(resp.Errors, e.Error())
+		}
+		if nsErr != nil {
+			resp.ResolvConfError = nsErr.Error()
+		} else {
+			resp.NameserversAdded = append(resp.NameserversAdded, addNS...)
+			resp.NameserversRemoved = append(resp.NameserversRemoved, delNS...)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
 
-	printDNSConfChangeInfo(w, "add", add)
-	printDNSConfChangeInfo(w, "delete", del)
-	printDNSConfChangeInfo(w, "change", change)
+	w.WriteHeader(status)
+	if err != nil {
+		fmt.Fprintf(w, "reload dns conf aborted in strict mode, keep using the old conf and nameservers.\n\n")
+	} else {
+		if dryRun {
+			fmt.Fprintf(w, "dry run, dns conf not reloaded.\n\n")
+		} else {
+			fmt.Fprintf(w, "reload dns conf done.\n\n")
+		}
+		diff.write(w)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(w, "dns conf error: %d\n", len(errs))
+		for _, e := range errs {
+			fmt.Fprintf(w, "\t %s\n", e)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	if err != nil {
+		return
+	}
+
+	if nsErr != nil {
+		fmt.Fprintf(w, "reload resolv.conf error: %s, keep using the old nameservers.\n", nsErr)
+		return
+	}
+	fmt.Fprintf(w, "nameservers add: %d\n", len(addNS))
+	for _, ns := range addNS {
+		fmt.Fprintf(w, "\t + %s\n", ns)
+	}
+	fmt.Fprintf(w, "nameservers delete: %d\n", len(delNS))
+	for _, ns := range delNS {
+		fmt.Fprintf(w, "\t - %s\n", ns)
+	}
 }
 
-func printDNSConfChangeInfo(w http.ResponseWriter, t string, list []string) {
-	fmt.Fprintf(w, "dns conf %s: %d\n", t, len(list))
-	for _, val := range list {
-		fmt.Fprintf(w, "\t %s %v\n", t, val)
+// confHistoryHandler 列出内存中保留的配置版本，* 为当前使用的版本，回滚之后显示配置文件固定在的版本
+func confHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	versions, pinned := listConfVersions()
+	fmt.Fprintf(w, "dns conf history: %d\n", len(versions))
+	if pinned != 0 {
+		fmt.Fprintf(w, "conf files pinned to version %d by rollback, changes are ignored until /reload_conf\n", pinned)
 	}
 	fmt.Fprintf(w, "\n")
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		mark := " "
+		if i == len(versions)-1 {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%s %d\t%s\t%s\t%s\t%s\n",
+			mark, v.version, v.loadedAt.Format("2006-01-02 15:04:05"), v.checksum[:12], v.reason, v.diff.summary())
+	}
+}
+
+// confVersionHandler 打印一个配置版本的变化和所有的记录，?version=N
+func confVersionHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil {
+		http.Error(w, "version is required", http.StatusBadRequest)
+		return
+	}
+	v := getConfVersion(version)
+	if v == nil {
+		http.Error(w, fmt.Sprintf("conf version %d not found", version), http.StatusNotFound)
+		return
+	}
+
+	fmt.Fprintf(w, "version: %d\nloaded at: %s\nchecksum: %s\nreason: %s\n\n",
+		v.version, v.loadedAt.Format("2006-01-02 15:04:05"), v.checksum, v.reason)
+	v.diff.write(w)
+
+	var records []string
+	for name, rrsAll := range v.snapshot.records {
+		for t, rrs := range rrsAll {
+			for _, rr := range rrs {
+				records = append(records, fmt.Sprintf("%s [%s]", rr, v.snapshot.sources[name][t]))
+			}
+		}
+	}
+	sort.Strings(records)
+	fmt.Fprintf(w, "dns conf records: %d\n", len(records))
+	for _, rr := range records {
+		fmt.Fprintf(w, "\t %s\n", rr)
+	}
+}
+
+// rollbackConfHandler 把配置回滚到历史中的版本，?version=N，不会修改配置目录中的文件
+func rollbackConfHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil {
+		http.Error(w, "version is required", http.StatusBadRequest)
+		return
+	}
+	v, err := rollbackConf(version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	lib.AppLog().Noticef("dns conf rollback to version %d, new version: %d\n", version, v.version)
+
+	fmt.Fprintf(w, "rollback dns conf to version %d done, new version: %d.\n", version, v.version)
+	fmt.Fprintf(w, "conf files are pinned to version %d, changes are ignored until /reload_conf.\n\n", version)
+	v.diff.write(w)
 }
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReloadConfHandlerErrors(t *testing.T) {
+	dir := setupTestConf(t, map[string]string{
+		"test.dns-conf": "a.example. IN A 10.0.0.1\n",
+		"resolv.conf":   "nameserver 127.0.0.1\n",
+	})
+	writeTestFiles(t, dir, map[string]string{
+		"test.dns-conf": "a.example. IN A 10.0.0.2\nbad.example. IN A 10.0.0.300\n",
+		"resolv.conf":   "nameserver 127.0.0.2\n",
+	})
+	oldResolver := currentResolver()
+
+	// 非严格模式下，响应中也要包含加载出错的行
+	req := httptest.NewRequest("GET", "/reload_conf?dry_run=1", nil)
+	w := httptest.NewRecorder()
+	reloadConfHandler(w, req)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "dns conf error: 1") || !strings.Contains(body, "at line: 2") {
+		t.Errorf("non-strict dry run: status %d, body:\n%s", w.Code, body)
+	}
+	if !strings.Contains(body, "nameservers add: 1") {
+		t.Errorf("non-strict dry run does not report the nameserver change:\n%s", body)
+	}
+
+	req = httptest.NewRequest("GET", "/reload_conf?dry_run=1", nil)
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	reloadConfHandler(w, req)
+	var resp reloadResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Errors) != 1 || resp.Added != 1 || resp.Removed != 1 {
+		t.Errorf("non-strict dry run json = %+v, want 1 error, 1 added and 1 removed", resp)
+	}
+
+	// 严格模式下出错的时候不替换配置，也不重新加载 resolv.conf
+	sc.StrictReload = true
+	req = httptest.NewRequest("GET", "/reload_conf", nil)
+	w = httptest.NewRecorder()
+	reloadConfHandler(w, req)
+	body = w.Body.String()
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(body, "dns conf error: 1") || strings.Contains(body, "nameservers add") {
+		t.Errorf("strict reload: status %d, body:\n%s", w.Code, body)
+	}
+	if currentResolver() != oldResolver {
+		t.Errorf("strict reload replaces the resolver after a conf error")
+	}
+	if m := testQuery(t, "a.example.", dns.TypeA); len(m.Answer) != 1 || !strings.Contains(m.Answer[0].String(), "10.0.0.1") {
+		t.Errorf("strict reload replaces the conf after an error: %v", m.Answer)
+	}
+}
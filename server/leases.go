@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// leaseTTL 是租约生成的记录使用的 TTL，租约随时可能结束，所以比较短
+	leaseTTL = 60
+	// defaultLeaseDomain 是 ServerConfig.LeaseDomain 没有设置的时候使用的域名
+	defaultLeaseDomain = "lan."
+)
+
+// 所有租约文件的 Provider，启动之后不再修改
+var leaseProviders []*leaseProvider
+
+// initLeaseProviders 为每个租约文件注册一个 Provider，优先级低于配置文件和之前注册的 Provider
+func initLeaseProviders(paths []string, domain string) {
+	for _, path := range paths {
+		p := newLeaseProvider(path, domain)
+		leaseProviders = append(leaseProviders, p)
+		RegisterProvider(p)
+	}
+}
+
+// dhcpLease 是一个 DHCP 租约
+type dhcpLease struct {
+	ip       net.IP
+	hostname string
+	// 租约结束的时间，零值表示不会结束
+	ends time.Time
+}
+
+// leaseProvider 从 dnsmasq 或者 ISC dhcpd 的租约文件生成记录：
+// 每个有主机名的租约生成 <hostname>.<domain> 的 A 或者 AAAA 记录，以及对应的 PTR 记录。
+// 租约文件变化或者租约结束的时候重新读取租约文件，用 MemoryProvider 替换所有的记录。
+type leaseProvider struct {
+	*MemoryProvider
+	path   string
+	domain string
+
+	mu sync.Mutex
+	// 最后一次读取的租约中最早的结束时间，用于在租约结束的时候重新读取
+	nextExpiry time.Time
+	// 最后一次读取的有效租约的数量
+	active int
+}
+
+// newLeaseProvider 创建租约文件的 Provider，读取租约文件之后在后台监听租约文件的变化和租约的结束
+func newLeaseProvider(path, domain string) *leaseProvider {
+	if domain == "" {
+		domain = defaultLeaseDomain
+	}
+	p := &leaseProvider{
+		MemoryProvider: NewMemoryProvider("leases:" + path),
+		path:           path,
+		domain:         normalizeName(domain),
+	}
+	p.reload()
+	go p.watch()
+	return p
+}
+
+// reload 读取租约文件，用有效的租约生成的记录替换原来的记录
+func (p *leaseProvider) reload() {
+	data, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		// DHCP 服务还没有写租约文件
+		p.setLeases(0, time.Time{})
+		p.Replace(nil, nil)
+		return
+	} else if err != nil {
+		p.Replace(nil, []error{err})
+		return
+	}
+
+	var leases []dhcpLease
+	var errs []error
+	if iscLeaseRE.Match(data) {
+		leases, errs = parseISCLeases(p.path, data)
+	} else {
+		leases, errs = parseDnsmasqLeases(p.path, data)
+	}
+
+	now := time.Now()
+	var rrs []dns.RR
+	var nextExpiry time.Time
+	active := 0
+	// 一个IP只生成一条 PTR 记录，文件中后面的租约是更新的
+	ptrs := map[string]*dns.PTR{}
+	var reverses []string
+	for _, lease := range leases {
+		if !lease.ends.IsZero() {
+			if !lease.ends.After(now) {
+				continue
+			}
+			if nextExpiry.IsZero() || lease.ends.Before(nextExpiry) {
+				nextExpiry = lease.ends
+			}
+		}
+		active++
+		name := lease.hostname + "." + p.domain
+		rrs = append(rrs, newAddrRR(name, lease.ip, leaseTTL))
+		reverse, _ := dns.ReverseAddr(lease.ip.String())
+		if _, ok := ptrs[reverse]; !ok {
+			reverses = append(reverses, reverse)
+		}
+		ptrs[reverse] = &dns.PTR{
+			Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: leaseTTL},
+			Ptr: name,
+		}
+	}
+	for _, reverse := range reverses {
+		rrs = append(rrs, ptrs[reverse])
+	}
+
+	p.setLeases(active, nextExpiry)
+	p.Replace(rrs, errs)
+}
+
+// setLeases 记录有效租约的数量和最早的结束时间
+func (p *leaseProvider) setLeases(active int, nextExpiry time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active = active
+	p.nextExpiry = nextExpiry
+}
+
+// watch 定期检查租约文件的大小和修改时间，以及是否有租约结束，有变化的时候重新读取租约文件
+func (p *leaseProvider) watch() {
+	last := pollFileStateOf(p.path)
+	for {
+		time.Sleep(watchPollInterval)
+		if current := pollFileStateOf(p.path); current != last {
+			last = current
+			logInstance.Debugf("lease file [%s] changed\n", p.path)
+			p.reload()
+			continue
+		}
+
+		p.mu.Lock()
+		expired := !p.nextExpiry.IsZero() && !time.Now().Before(p.nextExpiry)
+		p.mu.Unlock()
+		if expired {
+			logInstance.Debugf("lease in [%s] expired\n", p.path)
+			p.reload()
+		}
+	}
+}
+
+// activeLeases 返回最后一次加载的有效租约的数量
+func (p *leaseProvider) activeLeases() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active
+}
+
+// leaseHostname 把 DHCP 客户端发送的主机名转换为一个小写的域名标签，不合法的时候返回空字符串
+func leaseHostname(hostname string) string {
+	hostname = strings.ToLower(hostname)
+	if i := strings.IndexByte(hostname, '.'); i >= 0 {
+		hostname = hostname[:i]
+	}
+	if hostname == "" || len(hostname) > 63 || hostname[0] == '-' || hostname[len(hostname)-1] == '-' {
+		return ""
+	}
+	for i := 0; i < len(hostname); i++ {
+		c := hostname[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return ""
+		}
+	}
+	return hostname
+}
+
+// parseDnsmasqLeases 解析 dnsmasq.leases，每一行的格式为 "结束时间 MAC IP 主机名 客户端ID"，
+// 结束时间为 unix 时间，0 表示不会结束，没有主机名的时候为 *。IPv6 租约的第二列为 IAID，
+// "duid" 开头的行是服务器的 DUID。
+func parseDnsmasqLeases(path string, data []byte) (leases []dhcpLease, errs []error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		}
+		if len(fields) < 4 {
+			errs = append(errs, fmt.Errorf("%s: bad lease at line: %d", path, lineNo))
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		ip := net.ParseIP(fields[2])
+		if err != nil || ip == nil {
+			errs = append(errs, fmt.Errorf("%s: bad lease at line: %d", path, lineNo))
+			continue
+		}
+		hostname := leaseHostname(fields[3])
+		if hostname == "" {
+			continue
+		}
+		lease := dhcpLease{ip: ip, hostname: hostname}
+		if expiry != 0 {
+			lease.ends = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return
+}
+
+// iscLeaseRE 用于判断是否为 ISC dhcpd 的租约文件
+var iscLeaseRE = regexp.MustCompile(`(?m)^\s*lease\s+\S+\s*\{`)
+
+// parseISCLeases 解析 ISC dhcpd.leases，只使用 binding state 为 active 的租约。
+// 文件中同一个IP后面的租约会覆盖前面的租约。结束时间的格式为 "ends 星期 年/月/日 时:分:秒;"（UTC），
+// "ends epoch unix时间;" 或者 "ends never;"。
+func parseISCLeases(path string, data []byte) (leases []dhcpLease, errs []error) {
+	type iscLease struct {
+		dhcpLease
+		active bool
+	}
+	var order []string
+	byIP := map[string]*iscLease{}
+	var cur *iscLease
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case len(fields) == 0:
+		case cur == nil && fields[0] == "lease" && strings.HasSuffix(line, "{"):
+			ip := net.ParseIP(strings.TrimSuffix(fields[1], "{"))
+			if ip == nil {
+				errs = append(errs, fmt.Errorf("%s: bad lease address at line: %d", path, lineNo))
+				ip = net.IPv4zero
+			}
+			cur = &iscLease{dhcpLease: dhcpLease{ip: ip}, active: true}
+		case cur == nil:
+		case fields[0] == "}":
+			if !cur.ip.Equal(net.IPv4zero) {
+				key := cur.ip.String()
+				if _, ok := byIP[key]; !ok {
+					order = append(order, key)
+				}
+				byIP[key] = cur
+			}
+			cur = nil
+		case fields[0] == "ends":
+			ends, err := parseISCLeaseTime(fields[1:])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s at line: %d", path, err, lineNo))
+				continue
+			}
+			cur.ends = ends
+		case len(fields) >= 3 && fields[0] == "binding" && fields[1] == "state":
+			cur.active = fields[2] == "active"
+		case fields[0] == "client-hostname" && len(fields) >= 2:
+			cur.hostname = leaseHostname(strings.Trim(strings.Join(fields[1:], " "), `"`))
+		}
+	}
+
+	for _, key := range order {
+		if lease := byIP[key]; lease.active && lease.hostname != "" {
+			leases = append(leases, lease.dhcpLease)
+		}
+	}
+	return
+}
+
+// parseISCLeaseTime 解析 ISC dhcpd.leases 中的时间，never 返回零值
+func parseISCLeaseTime(fields []string) (time.Time, error) {
+	switch {
+	case len(fields) == 1 && fields[0] == "never":
+		return time.Time{}, nil
+	case len(fields) == 2 && fields[0] == "epoch":
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad lease time %q", strings.Join(fields, " "))
+		}
+		return time.Unix(sec, 0), nil
+	case len(fields) == 3:
+		t, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad lease time %q", strings.Join(fields, " "))
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("bad lease time %q", strings.Join(fields, " "))
+}
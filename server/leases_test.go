@@ -0,0 +1,223 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// formatLeases 把租约格式化为 "主机名 IP 结束时间" 的列表，不会结束的租约结束时间为 never
+func formatLeases(leases []dhcpLease) []string {
+	var list []string
+	for _, l := range leases {
+		ends := "never"
+		if !l.ends.IsZero() {
+			ends = fmt.Sprint(l.ends.Unix())
+		}
+		list = append(list, l.hostname+" "+l.ip.String()+" "+ends)
+	}
+	return list
+}
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	tests := []struct {
+		desc   string
+		data   string
+		leases []string
+		errs   int
+	}{
+		{
+			desc:   "ipv4",
+			data:   "1700000000 aa:bb:cc:dd:ee:ff 192.168.1.10 laptop 01:aa:bb:cc:dd:ee:ff\n",
+			leases: []string{"laptop 192.168.1.10 1700000000"},
+		},
+		{
+			desc: "ipv6 with duid line",
+			data: "duid 00:01:00:01:2a:3b:4c:5d:aa:bb:cc:dd:ee:ff\n" +
+				"1700000000 1234 fd00::10 phone 00:01:00:01:aa\n",
+			leases: []string{"phone fd00::10 1700000000"},
+		},
+		{
+			desc:   "never expires",
+			data:   "0 aa:bb:cc:dd:ee:ff 192.168.1.11 printer *\n",
+			leases: []string{"printer 192.168.1.11 never"},
+		},
+		{
+			desc:   "no hostname",
+			data:   "1700000000 aa:bb:cc:dd:ee:ff 192.168.1.12 * *\n",
+			leases: nil,
+		},
+		{
+			desc:   "hostname is normalized",
+			data:   "1700000000 aa:bb:cc:dd:ee:ff 192.168.1.13 My-PC.home *\n",
+			leases: []string{"my-pc 192.168.1.13 1700000000"},
+		},
+		{
+			desc:   "invalid hostname",
+			data:   "1700000000 aa:bb:cc:dd:ee:ff 192.168.1.14 bad_name *\n",
+			leases: nil,
+		},
+		{
+			desc: "bad lines are skipped",
+			data: "1700000000 aa:bb:cc:dd:ee:ff\n" +
+				"soon aa:bb:cc:dd:ee:ff 192.168.1.15 a *\n" +
+				"1700000000 aa:bb:cc:dd:ee:ff 192.168.1.300 b *\n" +
+				"1700000000 aa:bb:cc:dd:ee:ff 192.168.1.16 c *\n",
+			leases: []string{"c 192.168.1.16 1700000000"},
+			errs:   3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			leases, errs := parseDnsmasqLeases("dnsmasq.leases", []byte(tt.data))
+			if got := formatLeases(leases); fmt.Sprint(got) != fmt.Sprint(tt.leases) {
+				t.Errorf("leases = %v, want %v", got, tt.leases)
+			}
+			if len(errs) != tt.errs {
+				t.Errorf("errors = %v, want %d errors", errs, tt.errs)
+			}
+		})
+	}
+}
+
+func TestParseISCLeases(t *testing.T) {
+	tests := []struct {
+		desc   string
+		data   string
+		leases []string
+		errs   int
+	}{
+		{
+			desc: "active lease with date",
+			data: `lease 192.168.1.10 {
+  starts 4 2023/11/09 22:00:00;
+  ends 4 2023/11/14 22:13:20;
+  binding state active;
+  client-hostname "laptop";
+}
+`,
+			leases: []string{"laptop 192.168.1.10 1700000000"},
+		},
+		{
+			desc: "ends epoch and never",
+			data: `lease 192.168.1.11 {
+  ends epoch 1700000000; # 2023/11/14 22:13:20
+  client-hostname "a";
+}
+lease 192.168.1.12 {
+  ends never;
+  client-hostname "b";
+}
+`,
+			leases: []string{"a 192.168.1.11 1700000000", "b 192.168.1.12 never"},
+		},
+		{
+			desc: "inactive binding state",
+			data: `lease 192.168.1.13 {
+  ends never;
+  binding state free;
+  client-hostname "gone";
+}
+`,
+			leases: nil,
+		},
+		{
+			desc: "later block overrides earlier one",
+			data: `lease 192.168.1.14 {
+  ends never;
+  binding state active;
+  client-hostname "old";
+}
+lease 192.168.1.15 {
+  ends never;
+  client-hostname "other";
+}
+lease 192.168.1.14 {
+  ends never;
+  binding state active;
+  client-hostname "new";
+}
+lease 192.168.1.15 {
+  ends never;
+  binding state expired;
+  client-hostname "other";
+}
+`,
+			leases: []string{"new 192.168.1.14 never"},
+		},
+		{
+			desc: "no hostname",
+			data: `lease 192.168.1.16 {
+  ends never;
+}
+`,
+			leases: nil,
+		},
+		{
+			desc: "bad time and address",
+			data: `lease 192.168.1.300 {
+  ends never;
+  client-hostname "bad-ip";
+}
+lease 192.168.1.17 {
+  ends someday;
+  client-hostname "bad-time";
+}
+`,
+			leases: []string{"bad-time 192.168.1.17 never"},
+			errs:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			leases, errs := parseISCLeases("dhcpd.leases", []byte(tt.data))
+			if got := formatLeases(leases); fmt.Sprint(got) != fmt.Sprint(tt.leases) {
+				t.Errorf("leases = %v, want %v", got, tt.leases)
+			}
+			if len(errs) != tt.errs {
+				t.Errorf("errors = %v, want %d errors", errs, tt.errs)
+			}
+		})
+	}
+}
+
+func TestLeaseProvider(t *testing.T) {
+	dir := t.TempDir()
+	future := time.Now().Add(time.Hour).Unix()
+	writeTestFiles(t, dir, map[string]string{
+		"dnsmasq.leases": fmt.Sprintf("%d aa:bb:cc:dd:ee:01 192.168.1.10 laptop *\n", future) +
+			"1 aa:bb:cc:dd:ee:02 192.168.1.11 expired *\n" +
+			"0 aa:bb:cc:dd:ee:03 192.168.1.12 printer *\n",
+	})
+	p := newLeaseProvider(filepath.Join(dir, "dnsmasq.leases"), "home")
+
+	rrsets, errs := p.Load()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	var got []string
+	for _, rrset := range rrsets {
+		for _, rr := range rrset.RRs {
+			got = append(got, strings.Replace(rr.String(), "\t", " ", -1))
+		}
+	}
+	want := []string{
+		"laptop.home. 60 IN A 192.168.1.10",
+		"printer.home. 60 IN A 192.168.1.12",
+		"10.1.168.192.in-addr.arpa. 60 IN PTR laptop.home.",
+		"12.1.168.192.in-addr.arpa. 60 IN PTR printer.home.",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("records =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if p.activeLeases() != 2 {
+		t.Errorf("active leases = %d, want 2", p.activeLeases())
+	}
+	if rrsets[0].Source != p.Name() || rrsets[0].Type != dns.TypeA {
+		t.Errorf("first rrset = %+v, want an A rrset from %s", rrsets[0], p.Name())
+	}
+}
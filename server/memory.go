@@ -0,0 +1,94 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// MemoryProvider 是保存在内存中的记录的 Provider，可以用于测试，
+// 也可以作为服务注册中心等动态来源的基础：把最新的记录用 Replace 替换进来即可。
+// 记录有变化的时候通过 Changes 通知重新加载。
+type MemoryProvider struct {
+	name    string
+	changes chan string
+
+	mu      sync.Mutex
+	records []dns.RR
+	errs    []error
+}
+
+// NewMemoryProvider 创建一个没有记录的 MemoryProvider
+func NewMemoryProvider(name string) *MemoryProvider {
+	return &MemoryProvider{
+		name:    name,
+		changes: make(chan string, 1),
+	}
+}
+
+func (p *MemoryProvider) Name() string {
+	return p.name
+}
+
+func (p *MemoryProvider) Load() ([]RRset, []error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return groupRRsets(p.records, p.name), append([]error(nil), p.errs...)
+}
+
+func (p *MemoryProvider) Changes() <-chan string {
+	return p.changes
+}
+
+// Add 增加记录，记录的名字会转换为小写的完整域名
+func (p *MemoryProvider) Add(rrs ...dns.RR) {
+	p.mu.Lock()
+	for _, rr := range rrs {
+		p.records = append(p.records, normalizeRR(rr))
+	}
+	p.mu.Unlock()
+	p.notify()
+}
+
+// Remove 删除名字、class 和 type 都相同的记录
+func (p *MemoryProvider) Remove(name string, class, rrtype uint16) {
+	name = normalizeName(name)
+	p.mu.Lock()
+	records := p.records[:0:0]
+	for _, rr := range p.records {
+		if h := rr.Header(); h.Name != name || h.Class != class || h.Rrtype != rrtype {
+			records = append(records, rr)
+		}
+	}
+	p.records = records
+	p.mu.Unlock()
+	p.notify()
+}
+
+// Replace 用 rrs 替换所有的记录，errs 为生成这些记录的时候出现的错误，会在加载的时候返回
+func (p *MemoryProvider) Replace(rrs []dns.RR, errs []error) {
+	records := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		records = append(records, normalizeRR(rr))
+	}
+	p.mu.Lock()
+	p.records = records
+	p.errs = errs
+	p.mu.Unlock()
+	p.notify()
+}
+
+// notify 通知记录有变化，已经有没处理的通知的时候忽略
+func (p *MemoryProvider) notify() {
+	select {
+	case p.changes <- p.name + " changed":
+	default:
+	}
+}
+
+// normalizeRR 返回名字为小写完整域名的记录的副本
+func normalizeRR(rr dns.RR) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = normalizeName(rr.Header().Name)
+	return rr
+}
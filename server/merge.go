@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// mergeRRsets 按优先级合并多个 Provider 的 RRset，groups 按 Provider 的优先级从高到低排列。
+// 返回合并之后的记录、每个 RRset 的来源和冲突的说明。
+//
+// 合并的规则：
+//   - 同一个 RRset（名字、class 和 type 都相同）只使用优先级最高的 Provider 中的记录，
+//     其他 Provider 中的同一个 RRset 会被忽略并报告冲突；
+//   - 同一个名字下有 CNAME 记录，而且记录来自多个 Provider 的时候，只使用这个名字下优先级最高的
+//     Provider 中的记录，其他 Provider 中这个名字下的记录会被忽略并报告冲突。
+func mergeRRsets(groups [][]RRset) (records map[string]map[[2]uint16][]dns.RR, sources map[string]map[[2]uint16]string, conflicts []string) {
+	records = map[string]map[[2]uint16][]dns.RR{}
+	sources = map[string]map[[2]uint16]string{}
+	// 每个 RRset 所在的 Provider 的下标
+	owners := map[string]map[[2]uint16]int{}
+
+	for i, rrsets := range groups {
+		for _, rrset := range rrsets {
+			if len(rrset.RRs) == 0 {
+				continue
+			}
+			name := normalizeName(rrset.Name)
+			t := [2]uint16{rrset.Class, rrset.Type}
+			if owner, ok := owners[name][t]; ok {
+				if owner != i {
+					conflicts = append(conflicts, fmt.Sprintf("%s %s %s from [%s] is overridden by [%s]",
+						name, dns.Class(t[0]), dns.Type(t[1]), rrset.Source, sources[name][t]))
+					continue
+				}
+				// 同一个 Provider 返回了多个相同的 RRset
+				records[name][t] = append(records[name][t], rrset.RRs...)
+				continue
+			}
+			if records[name] == nil {
+				records[name] = map[[2]uint16][]dns.RR{}
+				sources[name] = map[[2]uint16]string{}
+				owners[name] = map[[2]uint16]int{}
+			}
+			// 复制一份，避免 append 修改 Provider 的数据
+			records[name][t] = append([]dns.RR(nil), rrset.RRs...)
+			sources[name][t] = rrset.Source
+			owners[name][t] = i
+		}
+	}
+
+	for name, rrsAll := range records {
+		if _, ok := rrsAll[[2]uint16{dns.ClassINET, dns.TypeCNAME}]; !ok {
+			continue
+		}
+		top := len(groups)
+		for t := range rrsAll {
+			if owners[name][t] < top {
+				top = owners[name][t]
+			}
+		}
+		var topSource string
+		for t := range rrsAll {
+			if owners[name][t] == top {
+				topSource = sources[name][t]
+				break
+			}
+		}
+		for t := range rrsAll {
+			if owners[name][t] != top {
+				conflicts = append(conflicts, fmt.Sprintf("%s %s %s from [%s] is dropped: CNAME and other data from [%s]",
+					name, dns.Class(t[0]), dns.Type(t[1]), sources[name][t], topSource))
+				delete(rrsAll, t)
+				delete(sources[name], t)
+			}
+		}
+	}
+
+	sort.Strings(conflicts)
+	return
+}
@@ -1,8 +1,9 @@
 package server
 
 import (
+	"net"
 	"runtime"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-ping/ping"
@@ -17,42 +18,99 @@ type pingStatus struct {
 
 var (
 	nameserverPingStatus = map[string][]*pingStatus{}
+	// 正在 ping 的上游DNS服务器 -> 用于停止 ping 的 channel
+	pingStops = map[string]chan struct{}{}
+	// 保护 nameserverPingStatus 和 pingStops
+	pingLock sync.Mutex
 )
 
-func startMonitorNameservers() {
-	nameservers := resolver.Nameservers()
-	for i := 0; i < len(nameservers); i++ {
-		nameserver := strings.Split(nameservers[i], ":")[0]
-		nameserverPingStatus[nameserver] = []*pingStatus{nil, nil, nil}
-		go pingLoop(nameserver)
+// syncMonitorNameservers 为当前的上游DNS服务器启动 ping，并停止已经不再使用的上游DNS服务器的 ping
+func syncMonitorNameservers() {
+	hosts := map[string]bool{}
+	for _, nameserver := range currentResolver().Nameservers() {
+		host, _, err := net.SplitHostPort(nameserver)
+		if err != nil {
+			host = nameserver
+		}
+		hosts[host] = true
 	}
+
+	pingLock.Lock()
+	defer pingLock.Unlock()
+	for host, stop := range pingStops {
+		if !hosts[host] {
+			close(stop)
+			delete(pingStops, host)
+			delete(nameserverPingStatus, host)
+		}
+	}
+	for host := range hosts {
+		if _, ok := pingStops[host]; ok {
+			continue
+		}
+		stop := make(chan struct{})
+		pingStops[host] = stop
+		nameserverPingStatus[host] = []*pingStatus{nil, nil, nil}
+		go pingLoop(host, stop)
+	}
+}
+
+// pingStatusSnapshot 返回每个上游DNS服务器最近一次 ping 的结果，还没有结果的为 nil
+func pingStatusSnapshot() map[string]*pingStatus {
+	pingLock.Lock()
+	defer pingLock.Unlock()
+	statuses := make(map[string]*pingStatus, len(nameserverPingStatus))
+	for k, v := range nameserverPingStatus {
+		statuses[k] = v[0]
+	}
+	return statuses
 }
 
-func pingLoop(server string) {
+// pingNameserver ping 一次上游DNS服务器并返回统计，失败的时候返回 nil，测试中会替换
+var pingNameserver = doping
+
+// pingLoop 定期 ping 上游DNS服务器，直到 stop 被关闭。
+// 上游DNS服务器被删除之后又马上增加的时候，新的 pingLoop 使用新的 stop，
+// 原来的 pingLoop 在这次 ping 结束之后丢弃结果并退出，不会覆盖新的 pingLoop 的结果。
+func pingLoop(server string, stop chan struct{}) {
 	for {
-		doping(server)
-		time.Sleep(time.Second * 10)
+		stats := pingNameserver(server)
+		recordPing(server, stop, stats)
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second * 10):
+		}
 	}
 }
 
-func doping(server string) {
+// recordPing 保存 ping 的结果，stop 不是上游DNS服务器当前的 pingLoop 的时候丢弃结果，返回是否保存
+func recordPing(server string, stop chan struct{}, stats *ping.Statistics) bool {
+	pingLock.Lock()
+	defer pingLock.Unlock()
+	if stats == nil || pingStops[server] != stop {
+		// 上游DNS服务器在 ping 的过程中被删除，或者删除之后又增加了
+		return false
+	}
+	nameserverPingStatus[server][0] = &pingStatus{
+		time.Now(),
+		stats,
+	}
+	return true
+}
+
+func doping(server string) *ping.Statistics {
 	// fmt.Println("ping", server)
 	pinger, err := ping.NewPinger(server)
 	if err != nil {
 		lib.AppLog().Errorf("ping server [%s] faild: %s\n", server, err)
-		return
+		return nil
 	}
 	pinger.Count = 10
 	pinger.Timeout = time.Second * 30
 	if runtime.GOOS == "linux" {
 		pinger.SetPrivileged(true)
 	}
-	pinger.Run()                 // blocks until finished
-	stats := pinger.Statistics() // get send/receive/rtt stats
-	// fmt.Printf("%+#v\n", stats)
-
-	nameserverPingStatus[server][0] = &pingStatus{
-		time.Now(),
-		stats,
-	}
+	pinger.Run()               // blocks until finished
+	return pinger.Statistics() // get send/receive/rtt stats
 }
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"sync"
+	"testing"
+
+	"fpdns/lib"
+
+	"github.com/go-ping/ping"
+	"github.com/miekg/dns"
+)
+
+var (
+	testPingLock sync.Mutex
+	// testPingHook 处理测试中所有的 ping，为 nil 的时候 ping 直接返回 nil
+	testPingHook func(server string) *ping.Statistics
+)
+
+// testPing 替换 pingNameserver，把 ping 交给 testPingHook
+func testPing(server string) *ping.Statistics {
+	testPingLock.Lock()
+	hook := testPingHook
+	testPingLock.Unlock()
+	if hook == nil {
+		return nil
+	}
+	return hook(server)
+}
+
+func setTestPingHook(hook func(server string) *ping.Statistics) {
+	testPingLock.Lock()
+	testPingHook = hook
+	testPingLock.Unlock()
+}
+
+// setNameservers 替换上游DNS服务器并同步 ping
+func setNameservers(servers ...string) {
+	resolver.Store(&lib.Resolver{Config: &dns.ClientConfig{Servers: servers, Port: "53", Timeout: 1}})
+	syncMonitorNameservers()
+}
+
+func currentPingStop(server string) chan struct{} {
+	pingLock.Lock()
+	defer pingLock.Unlock()
+	return pingStops[server]
+}
+
+func TestPingReAddedNameserver(t *testing.T) {
+	started := make(chan string, 16)
+	release := make(chan struct{})
+	setTestPingHook(func(server string) *ping.Statistics {
+		started <- server
+		<-release
+		return &ping.Statistics{Addr: server}
+	})
+	defer func() {
+		setTestPingHook(nil)
+		close(release)
+		setNameservers()
+	}()
+
+	setNameservers("192.0.2.1")
+	if server := <-started; server != "192.0.2.1" {
+		t.Fatalf("ping %s, want 192.0.2.1", server)
+	}
+	oldStop := currentPingStop("192.0.2.1")
+
+	// 第一次 ping 还没有结束的时候删除之后又增加
+	setNameservers("192.0.2.2")
+	<-started
+	setNameservers("192.0.2.1", "192.0.2.2")
+	<-started
+	newStop := currentPingStop("192.0.2.1")
+	if newStop == nil || newStop == oldStop {
+		t.Fatal("re-added nameserver does not get a new ping loop")
+	}
+	select {
+	case <-oldStop:
+	default:
+		t.Fatal("ping loop of the removed nameserver is not stopped")
+	}
+
+	// 原来的 pingLoop 的结果被丢弃，新的 pingLoop 的结果被保存
+	stats := &ping.Statistics{Addr: "192.0.2.1"}
+	if recordPing("192.0.2.1", oldStop, stats) {
+		t.Error("result of the stopped ping loop is recorded")
+	}
+	if status := pingStatusSnapshot()["192.0.2.1"]; status != nil {
+		t.Errorf("status of the re-added nameserver = %+v, want none", status)
+	}
+	if !recordPing("192.0.2.1", newStop, stats) {
+		t.Error("result of the current ping loop is not recorded")
+	}
+	if status := pingStatusSnapshot()["192.0.2.1"]; status == nil || status.Statistics != stats {
+		t.Errorf("status of the re-added nameserver = %+v, want the new result", status)
+	}
+
+	setNameservers("192.0.2.2")
+	if _, ok := pingStatusSnapshot()["192.0.2.1"]; ok {
+		t.Error("removed nameserver still has a ping status")
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// 正在预取的条目，key 为 dns.Question.String()，避免同一个条目重复预取
+	prefetching sync.Map
+	// 限制同时预取的数量，容量为 ServerConfig.PrefetchConcurrency
+	prefetchSem chan struct{}
+	// 预取的次数
+	prefetches int64
+)
+
+// prefetch 在后台重新查询快要过期的热门缓存条目并更新缓存，同一个条目同时只预取一次，
+// 同时预取的数量达到 PrefetchConcurrency 的时候放弃这次预取
+func prefetch(netType string, r *dns.Msg, q dns.Question) {
+	key := q.String()
+	if _, loaded := prefetching.LoadOrStore(key, true); loaded {
+		return
+	}
+	select {
+	case prefetchSem <- struct{}{}:
+	default:
+		prefetching.Delete(key)
+		return
+	}
+	atomic.AddInt64(&prefetches, 1)
+
+	req := r.Copy()
+	go func() {
+		defer func() {
+			<-prefetchSem
+			prefetching.Delete(key)
+		}()
+		if _, err := lookupAndCache(netType, req, q); err != nil {
+			logInstance.Debugf("prefetch [type:%s, class:%s, name:%s] error: %s",
+				dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass], q.Name, err)
+		}
+	}()
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RRset 是名字、class 和 type 都相同的一组记录
+type RRset struct {
+	Name  string // 小写的完整域名，和记录的名字相同
+	Class uint16
+	Type  uint16
+	RRs   []dns.RR
+	// 记录的来源，显示在 /debug 和配置变化中，为空的时候使用 Provider 的名字
+	Source string
+}
+
+// Provider 是本地记录的来源，例如配置文件、DHCP 租约文件和服务注册中心。
+// 所有 Provider 的记录按优先级合并之后，和配置文件中的记录一样用于查询，见 mergeRRsets。
+type Provider interface {
+	// Name 返回 Provider 的名字，多个 Provider 的名字不能重复
+	Name() string
+	// Load 返回当前所有的 RRset 和加载过程中出现的错误。
+	// 返回的记录不能再被修改，开启了 ServerConfig.StrictReload 的时候有错误不会使用这次加载的记录，
+	// 继续使用这个 Provider 最后一次成功加载的记录，见 reloadDNSConf。
+	Load() ([]RRset, []error)
+	// Changes 返回通知记录变化的 channel，收到的内容为变化的原因，
+	// 收到通知之后只重新加载这个 Provider 的记录，和其他 Provider 最后一次加载的记录重新合并。
+	// 不会主动通知的 Provider 返回 nil。
+	Changes() <-chan string
+}
+
+// 通过 RegisterProvider 注册的 Provider，按优先级从高到低排列
+var registeredProviders []Provider
+
+// RegisterProvider 注册一个本地记录的来源，需要在 StartServer 之前调用。
+// 配置文件的优先级最高，其他 Provider 按注册的顺序优先级从高到低。
+func RegisterProvider(p Provider) {
+	registeredProviders = append(registeredProviders, p)
+}
+
+// providerRRsets 是每个 Provider 最后一次成功加载的 RRset，key 为 Provider 的名字，
+// 只重新加载一部分 Provider 的时候，其他 Provider 使用这里的记录。只在持有 reloadLock 的时候访问。
+var providerRRsets = map[string][]RRset{}
+
+// allProviders 返回所有的 Provider，按优先级从高到低排列
+func allProviders() []Provider {
+	return append([]Provider{confFiles}, registeredProviders...)
+}
+
+// watchProviders 收到 Provider 的变化通知之后重新加载这个 Provider 的记录
+func watchProviders() {
+	for _, p := range allProviders() {
+		if changes := p.Changes(); changes != nil {
+			go func(p Provider, changes <-chan string) {
+				for reason := range changes {
+					reloadNotifiedProvider(p, reason)
+				}
+			}(p, changes)
+		}
+	}
+}
+
+// reloadNotifiedProvider 重新加载收到通知的 Provider 的记录。
+// 配置文件重新加载成功之后再重新加载 resolv.conf，严格模式下配置文件出错的时候继续使用原来的上游DNS服务器
+func reloadNotifiedProvider(p Provider, reason string) {
+	if reloadDNSConfAndLog(reason, p) && p == confFiles {
+		reloadResolverAndLog(reason)
+	}
+}
+
+// loadProviders 重新加载 reload 中的 Provider 的记录，reload 为空的时候重新加载所有 Provider，
+// 其他 Provider 使用最后一次成功加载的记录，按优先级合并。
+// 开启了 ServerConfig.StrictReload 的时候，加载出错的 Provider 继续使用最后一次成功加载的记录，
+// 这些 Provider 在 rejected 中返回。
+// 返回新的快照、重新加载成功的 Provider 的记录和加载过程中出现的错误，
+// 替换快照之后需要用 saveProviderRRsets 保存重新加载的记录。调用的时候需要持有 reloadLock。
+func loadProviders(reload ...Provider) (_ *rrSnapshot, loaded map[string][]RRset, errs []error, rejected []Provider) {
+	loaded = map[string][]RRset{}
+	merged := map[string][]RRset{}
+	for _, p := range allProviders() {
+		rrsets, ok := providerRRsets[p.Name()]
+		if !ok || len(reload) == 0 || containsProvider(reload, p) {
+			newRRsets, pErrs := p.Load()
+			errs = append(errs, pErrs...)
+			if ok && sc.StrictReload && len(pErrs) > 0 {
+				rejected = append(rejected, p)
+			} else {
+				rrsets = newRRsets
+				for i := range rrsets {
+					if rrsets[i].Source == "" {
+						rrsets[i].Source = p.Name()
+					}
+				}
+				loaded[p.Name()] = rrsets
+			}
+		}
+		merged[p.Name()] = rrsets
+	}
+	return mergeProviderRRsets(merged), loaded, errs, rejected
+}
+
+// mergeProviderRRsets 按优先级合并所有 Provider 的 RRset 并创建快照，rrsets 的 key 为 Provider 的名字
+func mergeProviderRRsets(rrsets map[string][]RRset) *rrSnapshot {
+	var groups [][]RRset
+	for _, p := range allProviders() {
+		groups = append(groups, rrsets[p.Name()])
+	}
+	records, sources, conflicts := mergeRRsets(groups)
+	s := newRRSnapshot(records, sources, sc.AuthZones)
+	s.conflicts = conflicts
+	return s
+}
+
+// saveProviderRRsets 保存 loadProviders 重新加载的 Provider 的记录，调用的时候需要持有 reloadLock
+func saveProviderRRsets(loaded map[string][]RRset) {
+	for name, rrsets := range loaded {
+		providerRRsets[name] = rrsets
+	}
+}
+
+func containsProvider(providers []Provider, p Provider) bool {
+	for _, provider := range providers {
+		if provider == p {
+			return true
+		}
+	}
+	return false
+}
+
+// groupRRsets 把记录按名字、class 和 type 分成 RRset，记录的名字需要是小写的完整域名
+func groupRRsets(rrs []dns.RR, source string) []RRset {
+	var rrsets []RRset
+	index := map[string]int{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		key := h.Name + " " + dns.Class(h.Class).String() + " " + dns.Type(h.Rrtype).String()
+		i, ok := index[key]
+		if !ok {
+			i = len(rrsets)
+			index[key] = i
+			rrsets = append(rrsets, RRset{Name: h.Name, Class: h.Class, Type: h.Rrtype, Source: source})
+		}
+		rrsets[i].RRs = append(rrsets[i].RRs, rr)
+	}
+	return rrsets
+}
+
+// fileProvider 从 -conf_dir、-extra_conf_dirs 和 -remote_conf 中加载记录，见 confLoader
+type fileProvider struct {
+	changes chan string
+
+	// loaded 是最后一次 Load 的结果，applied 是最后一次被使用的加载的结果，只在持有 reloadLock 的时候访问。
+	// 加载的记录替换了正在使用的配置之后才用 commit 保存到 applied 中，
+	// dry run 和严格模式下取消的加载不会影响之后的重新加载。
+	loaded, applied confFilesState
+}
+
+// confFilesState 是一次加载配置文件得到的记录文件的 sha256 和找到的 resolv.conf
+type confFilesState struct {
+	checksum   string
+	resolvConf string
+}
+
+// confFiles 是配置文件的 Provider，优先级最高
+var confFiles = &fileProvider{changes: make(chan string, 1)}
+
+func (p *fileProvider) Name() string {
+	return "file"
+}
+
+func (p *fileProvider) Load() ([]RRset, []error) {
+	rrsets, state, errs := p.load()
+	p.loaded = state
+	return rrsets, errs
+}
+
+// load 加载所有的配置文件，返回记录、这次加载的 checksum 和 resolv.conf 以及加载过程中出现的错误
+func (p *fileProvider) load() ([]RRset, confFilesState, []error) {
+	l := newConfLoader(sc)
+	l.loadSources()
+	records, sources := l.finish()
+
+	var rrsets []RRset
+	for name, rrsAll := range records {
+		for t, rrs := range rrsAll {
+			rrsets = append(rrsets, RRset{Name: name, Class: t[0], Type: t[1], RRs: rrs, Source: sources[name][t]})
+		}
+	}
+	return rrsets, confFilesState{checksum: l.checksum(), resolvConf: l.resolvConf}, l.errs
+}
+
+// commit 在最后一次加载的记录替换了正在使用的配置之后调用，保存这次加载的 checksum 并使用找到的 resolv.conf
+func (p *fileProvider) commit() {
+	p.applied = p.loaded
+	if p.applied.resolvConf != "" {
+		resolvConfFile = p.applied.resolvConf
+	}
+}
+
+func (p *fileProvider) Changes() <-chan string {
+	return p.changes
+}
+
+// notify 通知配置文件有变化，已经有没处理的通知的时候忽略
+func (p *fileProvider) notify(reason string) {
+	select {
+	case p.changes <- reason:
+	default:
+	}
+}
+
+// normalizeName 返回小写的完整域名
+func normalizeName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// loadMemoryProviders 按顺序加载 providers 的记录，用于测试 mergeRRsets
+func loadMemoryProviders(providers ...*MemoryProvider) [][]RRset {
+	var groups [][]RRset
+	for _, p := range providers {
+		rrsets, _ := p.Load()
+		groups = append(groups, rrsets)
+	}
+	return groups
+}
+
+func TestMergeRRsets(t *testing.T) {
+	high := NewMemoryProvider("high")
+	high.Add(
+		mustRR(t, "a.example. 60 IN A 10.0.0.1"),
+		mustRR(t, "c.example. 60 IN CNAME a.example."),
+	)
+	low := NewMemoryProvider("low")
+	low.Add(
+		mustRR(t, "A.example. 60 IN A 10.0.1.1"),
+		mustRR(t, "a.example. 60 IN AAAA fd00::1"),
+		mustRR(t, "c.example. 60 IN TXT \"low\""),
+		mustRR(t, "d.example. 60 IN CNAME a.example."),
+		mustRR(t, "only-low.example. 60 IN A 10.0.1.2"),
+		mustRR(t, "only-low.example. 60 IN A 10.0.1.3"),
+	)
+	lowest := NewMemoryProvider("lowest")
+	lowest.Add(mustRR(t, "d.example. 60 IN A 10.0.2.1"))
+
+	records, sources, conflicts := mergeRRsets(loadMemoryProviders(high, low, lowest))
+
+	tests := []struct {
+		name   string
+		rrtype uint16
+		source string
+		values []string
+	}{
+		// 优先级高的 Provider 中的 RRset 覆盖优先级低的，名字不区分大小写
+		{"a.example.", dns.TypeA, "high", []string{"10.0.0.1"}},
+		// 没有冲突的类型使用优先级低的 Provider 的记录
+		{"a.example.", dns.TypeAAAA, "low", []string{"fd00::1"}},
+		{"c.example.", dns.TypeCNAME, "high", []string{"a.example."}},
+		{"d.example.", dns.TypeCNAME, "low", []string{"a.example."}},
+		{"only-low.example.", dns.TypeA, "low", []string{"10.0.1.2", "10.0.1.3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+dns.TypeToString[tt.rrtype], func(t *testing.T) {
+			key := [2]uint16{dns.ClassINET, tt.rrtype}
+			var values []string
+			for _, rr := range records[tt.name][key] {
+				fields := strings.Fields(rr.String())
+				values = append(values, fields[len(fields)-1])
+			}
+			if fmt.Sprint(values) != fmt.Sprint(tt.values) {
+				t.Errorf("records = %v, want %v", values, tt.values)
+			}
+			if sources[tt.name][key] != tt.source {
+				t.Errorf("source = %q, want %q", sources[tt.name][key], tt.source)
+			}
+		})
+	}
+
+	// 来自多个 Provider 的 CNAME 和其他记录，只保留优先级最高的 Provider 的记录
+	for _, dropped := range []struct {
+		name   string
+		rrtype uint16
+	}{{"c.example.", dns.TypeTXT}, {"d.example.", dns.TypeA}} {
+		if _, ok := records[dropped.name][[2]uint16{dns.ClassINET, dropped.rrtype}]; ok {
+			t.Errorf("%s %s is not dropped", dropped.name, dns.TypeToString[dropped.rrtype])
+		}
+	}
+
+	want := []string{
+		"a.example. IN A from [low] is overridden by [high]",
+		"c.example. IN TXT from [low] is dropped: CNAME and other data from [high]",
+		"d.example. IN A from [lowest] is dropped: CNAME and other data from [low]",
+	}
+	if !sort.StringsAreSorted(conflicts) || fmt.Sprint(conflicts) != fmt.Sprint(want) {
+		t.Errorf("conflicts =\n%s\nwant\n%s", strings.Join(conflicts, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// countingProvider 记录 Load 被调用的次数
+type countingProvider struct {
+	*MemoryProvider
+	loads int
+}
+
+func (p *countingProvider) Load() ([]RRset, []error) {
+	p.loads++
+	return p.MemoryProvider.Load()
+}
+
+func TestReloadOnlyNotifiedProvider(t *testing.T) {
+	setupTestConf(t, map[string]string{"test.dns-conf": "a.example. IN A 10.0.0.1\n"})
+	sc.StrictReload = true
+	good := &countingProvider{MemoryProvider: NewMemoryProvider("good")}
+	bad := &countingProvider{MemoryProvider: NewMemoryProvider("bad")}
+	RegisterProvider(good)
+	RegisterProvider(bad)
+	bad.Replace([]dns.RR{mustRR(t, "bad.example. IN A 10.0.1.1")}, nil)
+	if _, _, err := reloadDNSConf("test", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// bad 有错误，但是只重新加载 good 的时候不受严格模式影响，bad 使用最后一次成功加载的记录
+	bad.Replace([]dns.RR{mustRR(t, "bad.example. IN A 10.0.1.2")}, []error{errors.New("bad record")})
+	good.Add(mustRR(t, "good.example. IN A 10.0.2.1"))
+	loads := bad.loads
+	if _, _, err := reloadDNSConf("good changed", false, good); err != nil {
+		t.Fatalf("reload good: %s", err)
+	}
+	if bad.loads != loads {
+		t.Errorf("reloading good loads bad %d times", bad.loads-loads)
+	}
+	if m := testQuery(t, "good.example.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("good.example. = %v, want the new record", m.Answer)
+	}
+	if m := testQuery(t, "bad.example.", dns.TypeA); len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.1.1" {
+		t.Errorf("bad.example. = %v, want the last good record", m.Answer)
+	}
+
+	// 重新加载 bad 的时候在严格模式下取消
+	if _, errs, err := reloadDNSConf("bad changed", false, bad); err == nil || len(errs) != 1 {
+		t.Errorf("reload bad = %v, %v, want a strict error", errs, err)
+	}
+	if m := testQuery(t, "bad.example.", dns.TypeA); len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.1.1" {
+		t.Errorf("bad.example. after strict error = %v, want the last good record", m.Answer)
+	}
+	if m := testQuery(t, "a.example.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("a.example. = %v, want the conf record", m.Answer)
+	}
+}
+
+// TestStrictFullReloadWithLeaseError 租约文件有错误的时候，修复之后的配置文件仍然可以重新加载
+func TestStrictFullReloadWithLeaseError(t *testing.T) {
+	dir := setupTestConf(t, map[string]string{"test.dns-conf": "a.example. IN A 10.0.0.1\n"})
+	sc.StrictReload = true
+	future := time.Now().Add(time.Hour).Unix()
+	leaseFile := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	writeTestFiles(t, filepath.Dir(leaseFile), map[string]string{
+		"dnsmasq.leases": fmt.Sprintf("%d aa:bb:cc:dd:ee:01 192.168.1.10 laptop *\n", future),
+	})
+	leases := newLeaseProvider(leaseFile, "lan.")
+	RegisterProvider(leases)
+	if _, _, err := reloadDNSConf("test", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// 租约文件中增加了一个租约和一行错误，只重新加载租约文件的时候取消
+	writeTestFiles(t, filepath.Dir(leaseFile), map[string]string{
+		"dnsmasq.leases": fmt.Sprintf("%d aa:bb:cc:dd:ee:01 192.168.1.10 laptop *\n", future) +
+			fmt.Sprintf("%d aa:bb:cc:dd:ee:02 192.168.1.11 phone *\n", future) +
+			"bad lease\n",
+	})
+	leases.reload()
+	if _, _, err := reloadDNSConf(leases.Name()+" changed", false, leases); err == nil {
+		t.Fatal("reload the bad lease file succeeds in strict mode")
+	}
+
+	// 配置文件出错的时候重新加载所有来源仍然取消
+	writeTestFiles(t, dir, map[string]string{"test.dns-conf": "a.example. IN A 10.0.0.300\n"})
+	if _, _, err := reloadDNSConf("test", false); err == nil {
+		t.Fatal("reload the bad conf file succeeds in strict mode")
+	}
+
+	// 修复配置文件之后可以重新加载，租约文件继续使用最后一次成功加载的记录，错误照常返回
+	writeTestFiles(t, dir, map[string]string{"test.dns-conf": "a.example. IN A 10.0.0.2\n"})
+	_, errs, err := reloadDNSConf("test", false)
+	if err != nil {
+		t.Fatalf("reload the fixed conf file: %s", err)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "dnsmasq.leases") {
+		t.Errorf("errors = %v, want the lease error", errs)
+	}
+	if ip := answerA(t, "a.example."); ip != "10.0.0.2" {
+		t.Errorf("a.example. = %s, want 10.0.0.2", ip)
+	}
+	if ip := answerA(t, "laptop.lan."); ip != "192.168.1.10" {
+		t.Errorf("laptop.lan. = %s, want the last good lease 192.168.1.10", ip)
+	}
+	if _, _, ok := currentRRSnapshot().lookup("phone.lan."); ok {
+		t.Error("phone.lan. is loaded from the rejected lease file")
+	}
+}
+
+// TestConfFilesCommitOnlyApplied dry run 和严格模式下取消的加载不改变配置文件的 checksum
+func TestConfFilesCommitOnlyApplied(t *testing.T) {
+	dir := setupTestConf(t, map[string]string{"test.dns-conf": "a.example. IN A 10.0.0.1\n"})
+	applied := confFiles.applied
+	if applied.checksum == "" || applied.checksum != confHistory[len(confHistory)-1].checksum {
+		t.Fatalf("startup checksum = %q, want the checksum of the first version", applied.checksum)
+	}
+
+	writeTestFiles(t, dir, map[string]string{"test.dns-conf": "a.example. IN A 10.0.0.2\n"})
+	if _, _, err := reloadDNSConf("test", true); err != nil {
+		t.Fatal(err)
+	}
+	if confFiles.applied != applied {
+		t.Errorf("dry run changes the applied checksum to %q", confFiles.applied.checksum)
+	}
+
+	sc.StrictReload = true
+	writeTestFiles(t, dir, map[string]string{"test.dns-conf": "a.example. IN A 10.0.0.300\n"})
+	if _, _, err := reloadDNSConf("test", false); err == nil {
+		t.Fatal("reload the bad conf file succeeds in strict mode")
+	}
+	if confFiles.applied != applied {
+		t.Errorf("strict abort changes the applied checksum to %q", confFiles.applied.checksum)
+	}
+
+	writeTestFiles(t, dir, map[string]string{"test.dns-conf": "a.example. IN A 10.0.0.2\n"})
+	if _, _, err := reloadDNSConf("test", false); err != nil {
+		t.Fatal(err)
+	}
+	if v := confHistory[len(confHistory)-1]; confFiles.applied.checksum == applied.checksum || confFiles.applied.checksum != v.checksum {
+		t.Errorf("applied checksum = %q, want the new version's %q", confFiles.applied.checksum, v.checksum)
+	}
+}
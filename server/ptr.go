@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// synthesizePTRs 为开启了自动生成 PTR 的 A 和 AAAA 记录生成 PTR 记录。
+//
+// 规则：
+//   - 配置文件中已经有 PTR 记录的IP不会再生成，配置的 PTR 记录优先；
+//   - 多个域名指向同一个IP的时候，使用最先加载的记录，配置目录中的文件按路径的字母顺序加载，
+//     同一个文件中按记录的顺序；
+//   - 泛解析记录不生成 PTR 记录；
+//   - 被优先级更高的来源覆盖的记录不生成 PTR 记录，生成的 PTR 记录属于 A 或 AAAA 记录的来源。
+//
+// 需要在合并所有来源的记录之后调用。
+func (l *confLoader) synthesizePTRs() {
+	synthesized := map[string]bool{}
+	for _, candidate := range l.autoPTRs {
+		rr := candidate.rr
+		h := rr.Header()
+		if strings.Contains(h.Name, "*") {
+			continue
+		}
+		if l.recordSources[h.Name][[2]uint16{h.Class, h.Rrtype}] != candidate.source {
+			continue
+		}
+
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		}
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		if synthesized[reverse] {
+			continue
+		}
+		if len(l.records[reverse][[2]uint16{h.Class, dns.TypePTR}]) > 0 {
+			// 配置了 PTR 记录
+			continue
+		}
+
+		synthesized[reverse] = true
+		l.addMerged(&dns.PTR{
+			Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: h.Class, Ttl: h.Ttl},
+			Ptr: h.Name,
+		}, candidate.source)
+	}
+}
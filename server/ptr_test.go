@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// loadPTRs 用 conf 加载 files 中的配置，返回所有的 PTR 记录，按记录名排序
+func loadPTRs(t *testing.T, conf ServerConfig, files map[string]string) []string {
+	t.Helper()
+	conf.ConfDir = t.TempDir()
+	writeTestFiles(t, conf.ConfDir, files)
+	l := newConfLoader(conf)
+	l.loadSources()
+	records, _ := l.finish()
+	if len(l.errs) > 0 {
+		t.Fatal(l.errs)
+	}
+	var ptrs []string
+	for _, rrsAll := range records {
+		for _, rr := range rrsAll[[2]uint16{dns.ClassINET, dns.TypePTR}] {
+			ptrs = append(ptrs, rr.String())
+		}
+	}
+	sort.Strings(ptrs)
+	return ptrs
+}
+
+func TestSynthesizePTRs(t *testing.T) {
+	files := map[string]string{
+		"a.dns-conf": strings.Join([]string{
+			"a.test. 60 IN A 10.0.0.1",
+			"b.test. 60 IN A 10.0.0.1",
+			"c.test. 60 IN A 10.0.0.2",
+			"10.0.0.2 60 IN PTR configured.test.",
+			"*.w.test. 60 IN A 10.0.0.5",
+			"v6.test. 60 IN AAAA 2001:db8::5",
+		}, "\n"),
+		// 按路径的字母顺序在 a.dns-conf 之后加载
+		"b.dns-conf": "d.test. 60 IN A 10.0.0.1\n",
+		"c.dns-conf": "$AUTO_PTR off\nz.test. 60 IN A 10.0.0.3\n",
+	}
+	want := []string{
+		"1.0.0.10.in-addr.arpa.\t60\tIN\tPTR\ta.test.",
+		"2.0.0.10.in-addr.arpa.\t60\tIN\tPTR\tconfigured.test.",
+		"5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.\t60\tIN\tPTR\tv6.test.",
+	}
+	if got := loadPTRs(t, ServerConfig{AutoPTR: true}, files); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("PTR records =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// 全局关闭的时候只有 $AUTO_PTR on 的文件生成 PTR 记录
+	files["c.dns-conf"] = "$AUTO_PTR on\nz.test. 60 IN A 10.0.0.3\n"
+	want = []string{
+		"2.0.0.10.in-addr.arpa.\t60\tIN\tPTR\tconfigured.test.",
+		"3.0.0.10.in-addr.arpa.\t60\tIN\tPTR\tz.test.",
+	}
+	if got := loadPTRs(t, ServerConfig{}, files); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("PTR records with auto_ptr off =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 拉取远程配置的超时时间
+	remoteConfTimeout = 30 * time.Second
+	// 远程配置的最大长度
+	remoteConfMaxSize = 64 << 20
+	// defaultRemoteConfInterval 是 ServerConfig.RemoteConfInterval 没有设置的时候拉取远程配置的间隔
+	defaultRemoteConfInterval = 60 * time.Second
+)
+
+// remoteConf 是通过 HTTP(S) 定期拉取的远程配置，内容为 tar.gz 格式的配置包，
+// 或者多个 .dns-conf 文件拼接在一起的内容。拉取失败的时候继续使用最后一次成功拉取的内容。
+type remoteConf struct {
+	url string
+	// 显示在日志、/debug 和配置变化中的来源，URL 中的密码被替换为 xxxxx
+	label string
+
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	// 最后一次成功拉取的内容
+	data []byte
+	// 最后一次成功拉取（包括内容没有变化）的时间
+	fetchedAt time.Time
+	// 最后一次拉取的错误，成功的时候为 nil
+	err error
+}
+
+// tar.gz 配置包解压之后的最大长度，包括跳过的文件，测试中会改小
+var remoteConfMaxUnpackedSize int64 = remoteConfMaxSize
+
+var (
+	// 所有的远程配置，按优先级从高到低排列，启动之后不再修改
+	remoteConfs []*remoteConf
+
+	remoteConfClient = &http.Client{Timeout: remoteConfTimeout}
+)
+
+// initRemoteConfs 第一次拉取所有的远程配置，拉取失败的远程配置在之后的轮询中重试
+func initRemoteConfs(urls []string) {
+	for _, url := range urls {
+		r := &remoteConf{url: url, label: redactURL(url)}
+		if _, err := r.fetch(); err != nil {
+			logInstance.Errorf("fetch remote conf [%s] error: %s\n", r.label, err)
+		}
+		remoteConfs = append(remoteConfs, r)
+	}
+}
+
+// pollRemoteConfs 定期拉取所有的远程配置，内容有变化的时候重新加载配置
+func pollRemoteConfs(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultRemoteConfInterval
+	}
+	for _, r := range remoteConfs {
+		go r.poll(interval)
+	}
+}
+
+func (r *remoteConf) poll(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		changed, err := r.fetch()
+		if err != nil {
+			logInstance.Warnf("fetch remote conf [%s] error: %s, keep using the last good copy\n", r.label, err)
+			continue
+		}
+		if changed {
+			confFiles.notify(fmt.Sprintf("remote conf [%s] changed", r.label))
+		}
+	}
+}
+
+// fetch 用 If-None-Match 和 If-Modified-Since 拉取远程配置，返回内容是否有变化
+func (r *remoteConf) fetch() (changed bool, err error) {
+	r.mu.Lock()
+	etag, lastModified := r.etag, r.lastModified
+	r.mu.Unlock()
+
+	defer func() {
+		// url.Error 中包含完整的 URL
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = r.label
+		}
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+	}()
+
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := remoteConfClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		r.mu.Lock()
+		r.fetchedAt = time.Now()
+		r.mu.Unlock()
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, remoteConfMaxSize+1))
+	if err != nil {
+		return false, err
+	}
+	if len(data) > remoteConfMaxSize {
+		return false, fmt.Errorf("remote conf is larger than %d bytes", remoteConfMaxSize)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed = !bytes.Equal(r.data, data)
+	r.data = data
+	r.etag = resp.Header.Get("ETag")
+	r.lastModified = resp.Header.Get("Last-Modified")
+	r.fetchedAt = time.Now()
+	return changed, nil
+}
+
+// redactURL 把 URL 中的密码替换为 xxxxx，用于显示
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// status 返回最后一次成功拉取的内容、时间和最后一次拉取的错误
+func (r *remoteConf) status() (data []byte, fetchedAt time.Time, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.data, r.fetchedAt, r.err
+}
+
+// loadRemote 加载远程配置最后一次成功拉取的内容。
+// tar.gz 格式的配置包中按文件的顺序加载 .dns-conf 和 .hosts 文件，远程配置中不能使用 $INCLUDE。
+// 解压之后的内容超过 remoteConfMaxUnpackedSize 的时候停止加载。
+func (l *confLoader) loadRemote(r *remoteConf) {
+	data, _, _ := r.status()
+	if data == nil {
+		return
+	}
+	l.addChecksum(r.url, data)
+
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		l.addDNSConf("", r.label, data)
+		return
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %s", r.label, err))
+		return
+	}
+	// 限制解压之后的总长度，包括跳过的文件
+	unpacked := &io.LimitedReader{R: gz, N: remoteConfMaxUnpackedSize + 1}
+	tooLarge := fmt.Errorf("%s: unpacked remote conf is larger than %d bytes", r.label, remoteConfMaxUnpackedSize)
+	tr := tar.NewReader(unpacked)
+	for {
+		hdr, err := tr.Next()
+		if unpacked.N <= 0 {
+			l.errs = append(l.errs, tooLarge)
+			return
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("%s: %s", r.label, err))
+			return
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		isDNSConf, isHosts := strings.HasSuffix(hdr.Name, ".dns-conf"), strings.HasSuffix(hdr.Name, ".hosts")
+		if !isDNSConf && !isHosts {
+			continue
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(tr, remoteConfMaxUnpackedSize+1))
+		if unpacked.N <= 0 || int64(len(content)) > remoteConfMaxUnpackedSize {
+			l.errs = append(l.errs, tooLarge)
+			return
+		}
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("%s: %s", r.label, err))
+			return
+		}
+		path := r.label + "#" + hdr.Name
+		if isDNSConf {
+			l.addDNSConf("", path, content)
+		} else {
+			l.addHosts(path, content)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRemoteConf 是测试用的远程配置服务器，支持 ETag
+type fakeRemoteConf struct {
+	mu     sync.Mutex
+	etag   string
+	body   []byte
+	status int
+	// 收到的请求数量和返回 304 的数量
+	requests, notModified int
+}
+
+func (f *fakeRemoteConf) set(status int, etag string, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status, f.etag, f.body = status, etag, body
+}
+
+func (f *fakeRemoteConf) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if f.status != http.StatusOK {
+		w.WriteHeader(f.status)
+		return
+	}
+	if f.etag != "" && r.Header.Get("If-None-Match") == f.etag {
+		f.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", f.etag)
+	w.Write(f.body)
+}
+
+// loadTestRemote 用 r 最后一次成功拉取的内容加载记录，返回 a.example. 的 A 记录和加载的错误
+func loadTestRemote(r *remoteConf) (string, []error) {
+	l := newConfLoader(ServerConfig{})
+	l.beginSource(r.label)
+	l.loadRemote(r)
+	records, _ := l.finish()
+	var ips []string
+	for _, rr := range records["a.example."][[2]uint16{1, 1}] {
+		ips = append(ips, strings.Fields(rr.String())[4])
+	}
+	return strings.Join(ips, ","), l.errs
+}
+
+func TestRemoteConfFetch(t *testing.T) {
+	f := &fakeRemoteConf{}
+	f.set(http.StatusOK, `"v1"`, []byte("a.example. IN A 10.0.0.1\n"))
+	server := httptest.NewServer(f)
+	defer server.Close()
+	r := &remoteConf{url: server.URL, label: redactURL(server.URL)}
+
+	if changed, err := r.fetch(); err != nil || !changed {
+		t.Fatalf("first fetch = %t, %v, want changed", changed, err)
+	}
+	// 内容没有变化的时候服务器返回 304
+	if changed, err := r.fetch(); err != nil || changed {
+		t.Errorf("fetch with the same ETag = %t, %v, want not changed", changed, err)
+	}
+	if f.notModified != 1 {
+		t.Errorf("304 responses = %d, want 1", f.notModified)
+	}
+
+	f.set(http.StatusOK, `"v2"`, []byte("a.example. IN A 10.0.0.2\n"))
+	if changed, err := r.fetch(); err != nil || !changed {
+		t.Errorf("fetch with a new ETag = %t, %v, want changed", changed, err)
+	}
+	if ip, errs := loadTestRemote(r); ip != "10.0.0.2" || len(errs) != 0 {
+		t.Errorf("records = %s, %v, want 10.0.0.2", ip, errs)
+	}
+
+	// 拉取失败的时候继续使用最后一次成功拉取的内容
+	f.set(http.StatusInternalServerError, "", nil)
+	if _, err := r.fetch(); err == nil {
+		t.Error("fetch succeeds with status 500")
+	}
+	if _, _, err := r.status(); err == nil {
+		t.Error("status does not report the fetch error")
+	}
+	if ip, errs := loadTestRemote(r); ip != "10.0.0.2" || len(errs) != 0 {
+		t.Errorf("records after a failed fetch = %s, %v, want the last good 10.0.0.2", ip, errs)
+	}
+}
+
+func TestRemoteConfRedactsPassword(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	rawURL := strings.Replace(server.URL, "http://", "http://user:secret@", 1) + "/conf"
+	server.Close()
+
+	r := &remoteConf{url: rawURL, label: redactURL(rawURL)}
+	if want := strings.Replace(rawURL, "secret", "xxxxx", 1); r.label != want {
+		t.Errorf("label = %q, want %q", r.label, want)
+	}
+	_, err := r.fetch()
+	if err == nil {
+		t.Fatal("fetch from a closed server succeeds")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("fetch error contains the password: %s", err)
+	}
+
+	r.data = []byte("a.example. IN A 10.0.0.300\n")
+	_, errs := loadTestRemote(r)
+	if len(errs) != 1 || strings.Contains(errs[0].Error(), "secret") {
+		t.Errorf("load errors = %v, want one error without the password", errs)
+	}
+}
+
+// testTarGz 返回包含 files 的 tar.gz 配置包，files 为文件名和内容交替排列
+func testTarGz(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for i := 0; i+1 < len(files); i += 2 {
+		hdr := &tar.Header{Name: files[i], Mode: 0644, Size: int64(len(files[i+1])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRemoteConfUnpackedLimit(t *testing.T) {
+	defer func(size int64) { remoteConfMaxUnpackedSize = size }(remoteConfMaxUnpackedSize)
+	remoteConfMaxUnpackedSize = 64 << 10
+	conf := "a.example. IN A 10.0.0.1\n"
+	big := strings.Repeat("; padding\n", 10<<10)
+
+	tests := []struct {
+		desc  string
+		files []string
+		ip    string
+		err   bool
+	}{
+		{"small bundle", []string{"a.dns-conf", conf, "README", "x"}, "10.0.0.1", false},
+		{"large conf file", []string{"a.dns-conf", conf + big}, "", true},
+		{"large skipped file", []string{"README", big, "a.dns-conf", conf}, "", true},
+		{"files loaded before the limit is reached", []string{"a.dns-conf", conf, "b.dns-conf", big}, "10.0.0.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			data := testTarGz(t, tt.files...)
+			r := &remoteConf{url: "http://conf.example/conf.tar.gz", label: "http://conf.example/conf.tar.gz", data: data}
+			ip, errs := loadTestRemote(r)
+			if ip != tt.ip {
+				t.Errorf("records = %q, want %q", ip, tt.ip)
+			}
+			sizeErr := len(errs) == 1 && strings.Contains(errs[0].Error(), "larger than")
+			if tt.err && !sizeErr || !tt.err && len(errs) > 0 {
+				t.Errorf("errors = %v, want the size error: %t", errs, tt.err)
+			}
+		})
+	}
+}
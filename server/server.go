@@ -1,8 +1,11 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"math/rand"
+	"net/http"
 	_ "net/http/pprof"
 	"strings"
 	"sync/atomic"
@@ -14,11 +17,38 @@ import (
 )
 
 type ServerConfig struct {
-	ConfDir  string // dns配置所在的目录
-	Addr     string // 监听的ip和端口， 例如 :53 或者 127.0.0.1:53
-	HttpAddr string // http服务监听的ip和端口， 例如 :8666 或者 127.0.0.1:8666
-
-	CacheTTL int // 缓存DNS解析结果的过期时间，单位秒。
+	ConfDir   string // dns配置所在的目录
+	HostsFile string // 额外加载的 hosts 文件，例如 /etc/hosts，相对路径相对于 ConfDir
+	Addr      string // 监听的ip和端口， 例如 :53 或者 127.0.0.1:53
+	HttpAddr  string // http服务监听的ip和端口， 例如 :8666 或者 127.0.0.1:8666
+
+	ExtraConfDirs      []string // 额外的配置目录，优先级低于 ConfDir，前面的优先
+	RemoteConfURLs     []string // 远程配置的 URL，tar.gz 配置包或者拼接在一起的 .dns-conf 文件，优先级低于本地目录
+	RemoteConfInterval int      // 拉取远程配置的间隔，单位秒
+
+	LeaseFiles  []string // DHCP 租约文件，dnsmasq.leases 或者 dhcpd.leases，有主机名的租约生成 A 和 PTR 记录
+	LeaseDomain string   // 租约生成的记录所在的域名，默认为 lan.
+
+	DockerSocket string // Docker Engine API 的 unix socket，例如 /var/run/docker.sock，为空则不发现容器
+
+	CacheTTL            int // 没有 SOA 记录的否定应答（NXDOMAIN 和 NODATA）的缓存时间，单位秒。
+	CacheMinTTL         int // 缓存DNS解析结果的最短时间，单位秒。解析结果的缓存时间为记录中最小的 TTL，并限制在 CacheMinTTL 和 CacheMaxTTL 之间
+	CacheMaxTTL         int // 缓存DNS解析结果的最长时间，单位秒。
+	CacheNegativeMaxTTL int // 缓存否定应答的最长时间，单位秒。否定应答的缓存时间为 SOA 记录的 TTL 和 MINIMUM 中较小的一个
+	CacheMaxStale       int // 缓存过期之后，上游DNS服务器解析失败的时候还可以返回旧的结果的最长时间，单位秒，为0则不返回过期的结果（RFC 8767）
+	CacheStaleTTL       int // 返回旧的结果的时候记录的 TTL，单位秒
+	CacheSize           int // 解析结果缓存最多使用的内存，单位MB，达到之后最早缓存的条目会被覆盖
+	StaleClientTimeout  int // 有旧的结果的时候等待上游DNS服务器的最长时间，单位毫秒，超时之后先返回旧的结果，在后台继续更新缓存。为0则一直等待
+
+	PrefetchHits        int     // 缓存条目的命中次数达到 PrefetchHits 之后才会被预取
+	PrefetchFraction    float64 // 缓存剩余时间不超过缓存时间的 PrefetchFraction 的时候在后台预取，为0则不预取
+	PrefetchConcurrency int     // 同时预取的最大数量
+
+	AuthZones    []string // 权威区域，区域内不存在的域名直接返回 NXDOMAIN，不再查询上游DNS服务器
+	AutoPTR      bool     // 是否为 .dns-conf 中的 A 和 AAAA 记录自动生成 PTR 记录，可以在文件中用 $AUTO_PTR 覆盖
+	WatchConf    bool     // 是否监听配置目录，文件变化的时候自动重新加载配置
+	StrictReload bool     // 严格模式，重新加载配置出现任何错误的时候取消这次加载，继续使用原来的配置
+	ConfHistory  int      // 在内存中保留的配置版本数量，用于回滚
 
 	LogFile  string // 日志文件路径，为空则输出到标准输出
 	LogLevel int    // 日志打印级别。ERROR:1, WARN:2, NOTICE:3, LOG:4, DEBUG:5, NO:0 。
@@ -28,15 +58,24 @@ var (
 	sc ServerConfig
 
 	resolvConfFile string
-	resolver       *lib.Resolver
+	// 当前使用的上游DNS服务器配置，保存的是 *lib.Resolver
+	resolver atomic.Value
 
-	// 自定义配置的域名列表
-	rrCache map[string]map[[2]uint16][]dns.RR
+	// 自定义配置的域名列表，保存的是当前使用的 *rrSnapshot
+	rrCache atomic.Value
 	// 远程解析的域名列表
 	resolvCache *lib.MemoryCache
 
 	logInstance lib.Logger
 
+	udpServer, tcpServer *dns.Server
+	httpServer           *http.Server
+
+	// 解析结果缓存的命中和未命中次数，否定应答（NXDOMAIN 和 NODATA）单独统计
+	cacheHits, cacheMisses, negativeCacheHits, negativeCacheMisses int64
+	// 返回过期的缓存结果的次数
+	staleAnswers int64
+
 	monitorCount  int64 //统计计算
 	currentQPS    float64
 	perTotalCount int64
@@ -46,10 +85,13 @@ var (
 
 const (
 	qpsInterval = 10
+
+	// 本地 CNAME 链最多跟随的层数
+	maxCNAMEDepth = 5
 )
 
 func init() {
-	rrCache = map[string]map[[2]uint16][]dns.RR{}
+	storeRRSnapshot(newRRSnapshot(map[string]map[[2]uint16][]dns.RR{}, nil, nil))
 
 	rand.Seed(time.Now().UTC().UnixNano())
 
@@ -72,18 +114,72 @@ func StartServer(c ServerConfig) {
 	// 	Maxcount: 0,
 	// }
 	var err error
-	resolvCache, err = lib.NewMemoryCache(sc.CacheTTL)
+	resolvCache, err = lib.NewMemoryCache(lib.CacheConfig{
+		TTL:            sc.CacheTTL,
+		MinTTL:         sc.CacheMinTTL,
+		MaxTTL:         sc.CacheMaxTTL,
+		NegativeMaxTTL: sc.CacheNegativeMaxTTL,
+		MaxStale:       sc.CacheMaxStale,
+		StaleTTL:       sc.CacheStaleTTL,
+		Size:           sc.CacheSize,
+
+		PrefetchHits:     sc.PrefetchHits,
+		PrefetchFraction: sc.PrefetchFraction,
+	})
 	if err != nil {
 		logInstance.Fatalf("init cache error: %s", err)
 	}
 
-	loadConf(sc.ConfDir)
+	prefetchSem = make(chan struct{}, sc.PrefetchConcurrency)
+
+	initRemoteConfs(sc.RemoteConfURLs)
+	initLeaseProviders(sc.LeaseFiles, sc.LeaseDomain)
+	initDockerProvider(sc.DockerSocket)
+	loadConf()
+	if sc.WatchConf {
+		var files []string
+		if path := sc.hostsFilePath(); path != "" {
+			files = append(files, path)
+		}
+		watchConfDirs(append([]string{sc.ConfDir}, sc.ExtraConfDirs...), files)
+	}
+	pollRemoteConfs(time.Duration(sc.RemoteConfInterval) * time.Second)
+	watchProviders()
 	initResolver()
 	listenAndServe()
-	go InitHTTP(sc.HttpAddr)
+	httpServer = &http.Server{Addr: sc.HttpAddr}
+	go InitHTTP(httpServer)
 	monitorQPS()
 }
 
+// Reload 重新加载 .dns-conf 等记录文件和 resolv.conf 中的上游DNS服务器，
+// 并重新打开日志文件，收到 SIGHUP 的时候调用
+func Reload() {
+	if err := lib.ReopenLogFile(); err != nil {
+		logInstance.Errorf("reopen log file error: %s\n", err)
+	}
+
+	// 和 /reload_conf 一样，严格模式下加载出错的时候也不重新加载 resolv.conf
+	if reloadDNSConfAndLog("SIGHUP received") {
+		reloadResolverAndLog("SIGHUP received")
+	}
+}
+
+// Shutdown 停止DNS和HTTP服务，不再接收新的请求，等待正在处理的请求完成或者 ctx 超时
+func Shutdown(ctx context.Context) error {
+	logInstance.Logln("shutting down, wait for in-flight requests")
+	var firstErr error
+	for _, s := range []*dns.Server{udpServer, tcpServer} {
+		if err := s.ShutdownContext(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := httpServer.Shutdown(ctx); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
 func monitorQPS() {
 	//定期刷新监控的最新信息
 	go func() {
@@ -102,21 +198,22 @@ func listenAndServe() {
 	udpHandler := dns.NewServeMux()
 	udpHandler.HandleFunc(".", handleUDPRequest)
 
-	server := &dns.Server{Addr: sc.Addr, Net: "udp"}
-	server.TsigSecret = map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
-	server.Handler = udpHandler
+	udpServer = &dns.Server{Addr: sc.Addr, Net: "udp"}
+	udpServer.TsigSecret = map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
+	udpServer.Handler = udpHandler
 	go func() {
-		err := server.ListenAndServe()
+		// Shutdown 之后 ListenAndServe 返回 nil
+		err := udpServer.ListenAndServe()
 		if err != nil {
 			logInstance.Fatalf("Failed to set udp listener %s\n", err.Error())
 		}
 	}()
 
-	tcpserver := &dns.Server{Addr: sc.Addr, Net: "tcp"}
-	tcpserver.TsigSecret = map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
-	tcpserver.Handler = tcpHandler
+	tcpServer = &dns.Server{Addr: sc.Addr, Net: "tcp"}
+	tcpServer.TsigSecret = map[string]string{"axfr.": "so6ZGir4GPAqINNh9U5c3A=="}
+	tcpServer.Handler = tcpHandler
 	go func() {
-		err := tcpserver.ListenAndServe()
+		err := tcpServer.ListenAndServe()
 		if err != nil {
 			logInstance.Fatalf("Failed to set tcp listener %s\n", err.Error())
 		}
@@ -181,102 +278,203 @@ func initResolver() {
 		logInstance.Errorf("%s is not a valid resolv.conf file\n", resolvConfFile)
 		panic(err)
 	}
-	resolver = &lib.Resolver{
+	resolver.Store(&lib.Resolver{
 		Config: clientConfig,
+	})
+	syncMonitorNameservers()
+}
+
+func currentResolver() *lib.Resolver {
+	return resolver.Load().(*lib.Resolver)
+}
+
+// reloadResolver 重新读取 resolv.conf，原子地替换上游DNS服务器的配置，同步上游DNS服务器的 ping，
+// 返回增加和删除的上游DNS服务器。读取失败的时候继续使用原来的配置，resolvCache 不受影响。
+// dryRun 为 true 的时候只返回变化，不替换正在使用的配置。
+func reloadResolver(dryRun bool) (add, del []string, err error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	clientConfig, err := dns.ClientConfigFromFile(resolvConfFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", resolvConfFile, err)
+	}
+	if len(clientConfig.Servers) == 0 {
+		return nil, nil, fmt.Errorf("%s: no nameserver", resolvConfFile)
+	}
+	newResolver := &lib.Resolver{Config: clientConfig}
+	add, del = diffNameservers(currentResolver().Nameservers(), newResolver.Nameservers())
+	if dryRun {
+		return
+	}
+	resolver.Store(newResolver)
+	syncMonitorNameservers()
+	return
+}
+
+// reloadResolverAndLog 重新加载 resolv.conf，把重新加载的原因和上游DNS服务器的变化打印到日志中
+func reloadResolverAndLog(reason string) {
+	add, del, err := reloadResolver(false)
+	if err != nil {
+		logInstance.Errorf("%s, reload resolv.conf error: %s, keep using the old nameservers\n", reason, err)
+		return
+	}
+	if len(add) > 0 || len(del) > 0 {
+		logInstance.Logf("%s, reload nameservers done. add: %v, delete: %v\n", reason, add, del)
 	}
-	startMonitorNameservers()
+}
+
+// diffNameservers 返回 newNS 中增加的和 oldNS 中删除的上游DNS服务器
+func diffNameservers(oldNS, newNS []string) (add, del []string) {
+	oldSet := map[string]bool{}
+	for _, ns := range oldNS {
+		oldSet[ns] = true
+	}
+	newSet := map[string]bool{}
+	for _, ns := range newNS {
+		newSet[ns] = true
+		if !oldSet[ns] {
+			add = append(add, ns)
+		}
+	}
+	for _, ns := range oldNS {
+		if !newSet[ns] {
+			del = append(del, ns)
+		}
+	}
+	return
 }
 
 func getFromResolver(netType string, r *dns.Msg) (message *dns.Msg, err error) {
 	q := r.Question[0]
 	q.Name = strings.ToLower(q.Name)
 
-	cacheMessage, cacheErr := resolvCache.Get(q)
+	cacheMessage, needPrefetch, cacheErr := resolvCache.GetWithPrefetch(q)
 	if cacheErr == nil && cacheMessage != nil {
+		if lib.IsNegative(cacheMessage) {
+			atomic.AddInt64(&negativeCacheHits, 1)
+		} else {
+			atomic.AddInt64(&cacheHits, 1)
+		}
+		if needPrefetch {
+			prefetch(netType, r, q)
+		}
 		message = cacheMessage
 		return
 	}
-	message, err = resolver.Lookup(netType, r)
-	if err != nil {
-		// 如果之前有缓存结果，则返回之前的缓存结果
-		if cacheErr == lib.KeyExpiredError && cacheMessage != nil {
-			message = cacheMessage
-			err = nil
+	stale := cacheErr == lib.KeyExpiredError && cacheMessage != nil
+	if !stale || sc.StaleClientTimeout <= 0 {
+		message, err = lookupAndCache(netType, r, q)
+		countMiss(message, err)
+		if stale && lookupFailed(message, err) {
+			// 上游DNS服务器解析失败，返回之前缓存的旧的结果
+			return serveStale(cacheMessage, q), nil
 		}
 		return
-	} else if message != nil {
-		resolvCache.Set(q, message)
 	}
-	return
-}
 
-func isIPQuery(r *dns.Msg) bool {
-	if len(r.Question) < 1 {
-		return false
+	// 有旧的结果的时候最多等待 StaleClientTimeout，超时之后先返回旧的结果，在后台继续更新缓存
+	type lookupResult struct {
+		message *dns.Msg
+		err     error
 	}
-	q := r.Question[0]
-	// 只处理IPV4的查询
-	if q.Qclass == dns.ClassINET && q.Qtype == dns.TypeA {
-		return true
+	done := make(chan lookupResult, 1)
+	go func() {
+		m, err := lookupAndCache(netType, r, q)
+		countMiss(m, err)
+		done <- lookupResult{m, err}
+	}()
+	timer := time.NewTimer(time.Duration(sc.StaleClientTimeout) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		if lookupFailed(res.message, res.err) {
+			return serveStale(cacheMessage, q), nil
+		}
+		return res.message, res.err
+	case <-timer.C:
+		return serveStale(cacheMessage, q), nil
+	}
+}
+
+// lookupAndCache 向上游DNS服务器查询并缓存结果，同时进行的相同的查询会被合并，见 coalesceLookup
+func lookupAndCache(netType string, r *dns.Msg, q dns.Question) (*dns.Msg, error) {
+	return coalesceLookup(netType, r, func() (*dns.Msg, error) {
+		message, err := currentResolver().Lookup(netType, r)
+		if err == nil && message != nil {
+			resolvCache.Set(q, message)
+		}
+		return message, err
+	})
+}
+
+// countMiss 统计缓存未命中的次数，上游返回否定应答的时候单独统计
+func countMiss(message *dns.Msg, err error) {
+	if err == nil && message != nil && lib.IsNegative(message) {
+		atomic.AddInt64(&negativeCacheMisses, 1)
+	} else {
+		atomic.AddInt64(&cacheMisses, 1)
 	}
-	return false
+}
+
+// lookupFailed 返回上游DNS服务器是否没有给出有效的结果，这时可以返回旧的结果（RFC 8767）
+func lookupFailed(message *dns.Msg, err error) bool {
+	return err != nil || message == nil ||
+		message.Rcode == dns.RcodeServerFailure || message.Rcode == dns.RcodeRefused
+}
+
+// serveStale 返回已经过期的缓存结果，记录的 TTL 已经在缓存中设置为 -stale_ttl
+func serveStale(message *dns.Msg, q dns.Question) *dns.Msg {
+	atomic.AddInt64(&staleAnswers, 1)
+	logInstance.Debugf("serve stale answer of [type:%s, class:%s, name:%s]",
+		dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass], q.Name)
+	return message
 }
 
 // @deep: 预防无限递归
 func queryDnsResult(netType string, r *dns.Msg, deep int) (*dns.Msg, error) {
-	if deep > 5 {
+	if deep > maxCNAMEDepth {
 		return nil, ErrCNAMELoop
 	}
 	m := new(dns.Msg)
 	q := r.Question[0]
 
-	_isIPQuery := isIPQuery(r)
 	getOk := false
 	name := strings.ToLower(q.Name)
-	rrsAll, ok := rrCache[name]
-
-	// wildcard records
-	if !ok && _isIPQuery { // ip查询才处理泛解析
-		// 泛解析查找
-		nameArr := strings.Split(name, ".")
-		for i := 0; i < len(nameArr)-3; i++ {
-			wildDomain := "*." + strings.Join(nameArr[i+1:], ".")
-			rrsAll, ok = rrCache[wildDomain]
-			if ok {
-				// rrs[0].Header().Name = name
-				break
-			}
-		}
+	snapshot := currentRRSnapshot()
+	rrsAll, _, ok := snapshot.lookup(name)
+	var zone *dns.SOA
+	if q.Qclass == dns.ClassINET {
+		zone = snapshot.findZone(name)
 	}
 
 	if ok {
 		rrs, ok := rrsAll[[2]uint16{q.Qclass, q.Qtype}]
 		if ok && len(rrs) > 0 {
+			rrs = copyRRs(rrs, name)
 			loadBalancing(rrs)
 		}
 		// CNAME
+		var mCNAME *dns.Msg
 		// 没找到记录的情况下，非CNAME查询则查一下是否有CNAME记录
 		if !ok && q.Qtype != dns.TypeCNAME { // q.Qtype 为CNAME的时候，直接返回
 			rrs, ok = rrsAll[[2]uint16{q.Qclass, dns.TypeCNAME}]
 
 			if ok && len(rrs) > 0 {
-				r2 := new(dns.Msg)
+				rrs = copyRRs(rrs, name)
 				rrCNAMME := rrs[0].(*dns.CNAME)
 				if strings.ToUpper(rrCNAMME.Target) == "DIRECT." {
 					logInstance.Debugf("will DIRECT resole [type:%s, class:%s, name:%s] from unstream resolver",
 						dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass], q.Name)
 					goto DirectGetFromResolver
 				}
-				// 查询CNAME目标的DNS解析记录
-				r2.Question = []dns.Question{
-					dns.Question{
-						Name:   rrCNAMME.Target,
-						Qtype:  dns.TypeA,
-						Qclass: dns.ClassINET,
-					},
-				}
+				// 用原始的查询类型查询CNAME目标的DNS解析记录
+				r2 := new(dns.Msg)
+				r2.SetQuestion(rrCNAMME.Target, q.Qtype)
+				r2.Question[0].Qclass = q.Qclass
 				deep++
-				mCNAME, err := queryDnsResult(netType, r2, deep)
+				var err error
+				mCNAME, err = queryDnsResult(netType, r2, deep)
 				if err != nil {
 					return nil, err
 				}
@@ -287,13 +485,42 @@ func queryDnsResult(netType string, r *dns.Msg, deep int) (*dns.Msg, error) {
 		}
 
 		if ok && len(rrs) > 0 {
-			rrs[0].Header().Name = name // 泛解析记录的时候需要这样特殊处理
 			m.Answer = rrs
 			m.SetReply(r)
+			m.Authoritative = zone != nil
+			if mCNAME != nil {
+				// CNAME 链的最终结果决定响应码(RFC 6604)，目标不存在或没有记录时带上上游的 SOA
+				m.Rcode = mCNAME.Rcode
+				if len(mCNAME.Answer) == 0 {
+					m.Ns = mCNAME.Ns
+				}
+			}
 			getOk = true
 			logInstance.Debugf("resole [type:%s, class:%s, name:%s] from local config",
 				dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass], q.Name)
+		} else if !ok {
+			// 名字存在但没有对应类型的记录，返回 NODATA
+			m.SetReply(r)
+			if zone != nil {
+				m.Authoritative = true
+				m.Ns = []dns.RR{negativeSOA(zone)}
+			}
+			getOk = true
+			logInstance.Debugf("resole [type:%s, class:%s, name:%s] from local config: NODATA",
+				dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass], q.Name)
+		}
+	} else if zone != nil {
+		// 权威区域内不存在的名字直接返回 NXDOMAIN，空的非终结节点返回 NODATA
+		m.SetReply(r)
+		m.Authoritative = true
+		if !snapshot.exists(name) {
+			m.Rcode = dns.RcodeNameError
 		}
+		m.Ns = []dns.RR{negativeSOA(zone)}
+		getOk = true
+		logInstance.Debugf("resole [type:%s, class:%s, name:%s] from local zone [%s]: %s",
+			dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass], q.Name,
+			zone.Hdr.Name, dns.RcodeToString[m.Rcode])
 	}
 
 DirectGetFromResolver:
@@ -309,6 +536,17 @@ DirectGetFromResolver:
 	return m, nil
 }
 
+// copyRRs 复制一份配置中的记录用于响应，并把记录名都设置为 name （泛解析的时候为查询的域名），
+// 避免修改共享的配置数据
+func copyRRs(rrs []dns.RR, name string) []dns.RR {
+	c := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		c[i] = dns.Copy(rr)
+		c[i].Header().Name = name
+	}
+	return c
+}
+
 func loadBalancing(rrs []dns.RR) {
 	rand.Shuffle(len(rrs), func(i, j int) {
 		rrs[i], rrs[j] = rrs[j], rrs[i]
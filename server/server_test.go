@@ -0,0 +1,317 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fpdns/lib"
+
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream 是测试用的上游DNS服务器
+type fakeUpstream struct {
+	// 收到的查询的数量
+	queries int64
+}
+
+// startFakeUpstream 在本地启动一个 UDP 的上游DNS服务器，所有查询交给 handler 处理，
+// 并把它设置为唯一的上游DNS服务器。
+func startFakeUpstream(t *testing.T, handler func(w dns.ResponseWriter, r *dns.Msg)) *fakeUpstream {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &fakeUpstream{}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddInt64(&u.queries, 1)
+			handler(w, r)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	host, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	resolver.Store(&lib.Resolver{Config: &dns.ClientConfig{Servers: []string{host}, Port: port, Timeout: 1}})
+	return u
+}
+
+func (u *fakeUpstream) count() int64 {
+	return atomic.LoadInt64(&u.queries)
+}
+
+// useTestCache 用 c 创建新的解析结果缓存
+func useTestCache(t *testing.T, c lib.CacheConfig) {
+	t.Helper()
+	var err error
+	if resolvCache, err = lib.NewMemoryCache(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testCacheConfig 是测试默认使用的缓存配置，和命令行参数的默认值相同
+var testCacheConfig = lib.CacheConfig{TTL: 60, MinTTL: 0, MaxTTL: 86400, NegativeMaxTTL: 3600, MaxStale: 86400, StaleTTL: 30}
+
+// answerWith 返回 r 的响应，包含 rrs 中的记录
+func answerWith(t *testing.T, r *dns.Msg, rrs ...string) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for _, s := range rrs {
+		m.Answer = append(m.Answer, mustRR(t, s))
+	}
+	return m
+}
+
+func TestReloadResolver(t *testing.T) {
+	dir := setupTestConf(t, map[string]string{"resolv.conf": "nameserver 192.0.2.1\nnameserver 192.0.2.2\n"})
+	defer setNameservers()
+	if _, _, err := reloadResolver(false); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFiles(t, dir, map[string]string{"resolv.conf": "nameserver 192.0.2.2\nnameserver 192.0.2.3\n"})
+	add, del, err := reloadResolver(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(add, []string{"192.0.2.3:53"}) || !reflect.DeepEqual(del, []string{"192.0.2.1:53"}) {
+		t.Errorf("dry run add %v, delete %v, want add [192.0.2.3:53], delete [192.0.2.1:53]", add, del)
+	}
+	want := []string{"192.0.2.1:53", "192.0.2.2:53"}
+	if got := currentResolver().Nameservers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("nameservers after dry run = %v, want %v", got, want)
+	}
+
+	if _, _, err := reloadResolver(false); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"192.0.2.2:53", "192.0.2.3:53"}
+	if got := currentResolver().Nameservers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("nameservers = %v, want %v", got, want)
+	}
+	statuses := pingStatusSnapshot()
+	if _, ok := statuses["192.0.2.1"]; ok || len(statuses) != 2 {
+		t.Errorf("pinged nameservers = %v, want 192.0.2.2 and 192.0.2.3", statuses)
+	}
+
+	// 没有 nameserver 的时候继续使用原来的上游DNS服务器
+	writeTestFiles(t, dir, map[string]string{"resolv.conf": "# empty\n"})
+	if _, _, err := reloadResolver(false); err == nil {
+		t.Error("reload resolv.conf without nameserver succeeds")
+	}
+	if got := currentResolver().Nameservers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("nameservers after a bad resolv.conf = %v, want %v", got, want)
+	}
+}
+
+// TestServeStale 上游DNS服务器失败或者超时的时候返回过期的缓存结果
+func TestServeStale(t *testing.T) {
+	setupTestConf(t, nil)
+	var rcode int32 = dns.RcodeServerFailure
+	upstream := startFakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, int(atomic.LoadInt32(&rcode)))
+		w.WriteMsg(m)
+	})
+	q := dns.Question{Name: "a.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	// TTL 为0的结果缓存之后马上过期
+	seedStale := func() {
+		t.Helper()
+		r := new(dns.Msg)
+		r.SetQuestion(q.Name, q.Qtype)
+		if err := resolvCache.Set(q, answerWith(t, r, "a.example. 0 IN A 10.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	useTestCache(t, testCacheConfig)
+	seedStale()
+	// 上游返回 SERVFAIL 的时候 Resolver 会返回错误，返回 REFUSED 的时候返回 REFUSED 的结果
+	for _, code := range []int32{dns.RcodeServerFailure, dns.RcodeRefused} {
+		atomic.StoreInt32(&rcode, code)
+		stale := atomic.LoadInt64(&staleAnswers)
+		m := testQuery(t, q.Name, q.Qtype)
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.Answer[0].Header().Ttl != 30 {
+			t.Errorf("upstream %s: answer %s %v, want the stale record with ttl 30", dns.RcodeToString[int(code)], dns.RcodeToString[m.Rcode], m.Answer)
+		}
+		if atomic.LoadInt64(&staleAnswers) != stale+1 {
+			t.Errorf("upstream %s: stale answers not counted", dns.RcodeToString[int(code)])
+		}
+	}
+
+	// 超过 max_stale 之后不再返回
+	config := testCacheConfig
+	config.MaxStale = 1
+	useTestCache(t, config)
+	seedStale()
+	time.Sleep(1100 * time.Millisecond)
+	if m := testQuery(t, q.Name, q.Qtype); m.Rcode != dns.RcodeRefused {
+		t.Errorf("answer after max_stale = %s %v, want REFUSED", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+
+	// max_stale 为0的时候不返回过期的结果
+	config.MaxStale = 0
+	useTestCache(t, config)
+	seedStale()
+	if m := testQuery(t, q.Name, q.Qtype); m.Rcode != dns.RcodeRefused {
+		t.Errorf("answer with max_stale 0 = %s %v, want REFUSED", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if n := upstream.count(); n != 4 {
+		t.Errorf("upstream queries = %d, want 4", n)
+	}
+}
+
+// TestStaleClientTimeout 上游DNS服务器超过 stale_client_timeout 没有返回的时候先返回旧的结果，
+// 查询在后台继续进行，得到结果之后更新缓存
+func TestStaleClientTimeout(t *testing.T) {
+	setupTestConf(t, nil)
+	sc.StaleClientTimeout = 100
+	release := make(chan struct{})
+	startFakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		<-release
+		w.WriteMsg(answerWith(t, r, "a.example. 60 IN A 10.0.0.2"))
+	})
+	useTestCache(t, testCacheConfig)
+	q := dns.Question{Name: "a.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	r := new(dns.Msg)
+	r.SetQuestion(q.Name, q.Qtype)
+	if err := resolvCache.Set(q, answerWith(t, r, "a.example. 0 IN A 10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	m := testQuery(t, q.Name, q.Qtype)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stale answer returned after %s, want about 100ms", elapsed)
+	}
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.1" || m.Answer[0].Header().Ttl != 30 {
+		t.Errorf("answer = %v, want the stale record with ttl 30", m.Answer)
+	}
+
+	close(release)
+	waitFor(t, "the background lookup to refresh the cache", func() bool {
+		m, err := resolvCache.Get(q)
+		return err == nil && len(m.Answer) == 1 && m.Answer[0].(*dns.A).A.String() == "10.0.0.2"
+	})
+	if m := testQuery(t, q.Name, q.Qtype); m.Answer[0].(*dns.A).A.String() != "10.0.0.2" || m.Answer[0].Header().Ttl > 60 {
+		t.Errorf("answer after refresh = %v, want 10.0.0.2", m.Answer)
+	}
+}
+
+// answerStrings 返回响应的响应码和记录，记录的 TTL 为0，方便比较
+func answerStrings(m *dns.Msg) []string {
+	result := []string{dns.RcodeToString[m.Rcode]}
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = 0
+			result = append(result, rr.String())
+		}
+	}
+	return result
+}
+
+// TestQueryCNAME 本地配置的 CNAME 用原始的查询类型查询目标，目标的结果决定响应码
+func TestQueryCNAME(t *testing.T) {
+	setupTestConf(t, map[string]string{"test.dns-conf": `
+www.test. 60 IN CNAME web.test.
+web.test. 60 IN AAAA ::1
+web.test. 60 IN MX 10 mail.test.
+zone.test. 60 IN SOA ns.zone.test. admin.zone.test. 1 7200 3600 1209600 300
+alias.zone.test. 60 IN CNAME a.zone.test.
+a.zone.test. 60 IN A 10.0.0.1
+missing.zone.test. 60 IN CNAME gone.zone.test.
+up.test. 60 IN CNAME nxdomain.upstream.
+nodata.test. 60 IN CNAME nodata.upstream.
+`})
+	useTestCache(t, testCacheConfig)
+	upstreamSOA := "upstream. 60 IN SOA ns.upstream. admin.upstream. 1 7200 3600 1209600 300"
+	startFakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := answerWith(t, r)
+		if r.Question[0].Name == "nxdomain.upstream." {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = []dns.RR{mustRR(t, upstreamSOA)}
+		w.WriteMsg(m)
+	})
+	localSOA := "zone.test.\t0\tIN\tSOA\tns.zone.test. admin.zone.test. 1 7200 3600 1209600 300"
+	upstreamNs := "upstream.\t0\tIN\tSOA\tns.upstream. admin.upstream. 1 7200 3600 1209600 300"
+
+	tests := []struct {
+		desc  string
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		{"AAAA through CNAME", "www.test.", dns.TypeAAAA, []string{"NOERROR",
+			"www.test.\t0\tIN\tCNAME\tweb.test.", "web.test.\t0\tIN\tAAAA\t::1"}},
+		{"MX through CNAME", "www.test.", dns.TypeMX, []string{"NOERROR",
+			"www.test.\t0\tIN\tCNAME\tweb.test.", "web.test.\t0\tIN\tMX\t10 mail.test."}},
+		{"CNAME query", "www.test.", dns.TypeCNAME, []string{"NOERROR", "www.test.\t0\tIN\tCNAME\tweb.test."}},
+		{"local NODATA target", "alias.zone.test.", dns.TypeAAAA, []string{"NOERROR",
+			"alias.zone.test.\t0\tIN\tCNAME\ta.zone.test.", localSOA}},
+		{"local NXDOMAIN target", "missing.zone.test.", dns.TypeA, []string{"NXDOMAIN",
+			"missing.zone.test.\t0\tIN\tCNAME\tgone.zone.test.", localSOA}},
+		{"upstream NXDOMAIN target", "up.test.", dns.TypeA, []string{"NXDOMAIN",
+			"up.test.\t0\tIN\tCNAME\tnxdomain.upstream.", upstreamNs}},
+		{"upstream NODATA target", "nodata.test.", dns.TypeAAAA, []string{"NOERROR",
+			"nodata.test.\t0\tIN\tCNAME\tnodata.upstream.", upstreamNs}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			m := testQuery(t, tt.name, tt.qtype)
+			if q := m.Question[0]; q.Name != tt.name || q.Qtype != tt.qtype {
+				t.Errorf("question = %s, want %s %s", q.String(), tt.name, dns.TypeToString[tt.qtype])
+			}
+			if got := answerStrings(m); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("answer =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestQueryCNAMEDepth 最多跟随 maxCNAMEDepth 层 CNAME，更深的链返回 ErrCNAMELoop
+func TestQueryCNAMEDepth(t *testing.T) {
+	chain := func(n int) string {
+		var conf string
+		for i := 0; i < n; i++ {
+			conf += fmt.Sprintf("c%d.test. 60 IN CNAME c%d.test.\n", i, i+1)
+		}
+		return conf + fmt.Sprintf("c%d.test. 60 IN A 10.0.0.1\n", n)
+	}
+	query := func() (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetQuestion("c0.test.", dns.TypeA)
+		return queryDnsResult("udp", r, 0)
+	}
+
+	setupTestConf(t, map[string]string{"test.dns-conf": chain(maxCNAMEDepth)})
+	m, err := query()
+	if err != nil {
+		t.Fatalf("chain of %d CNAMEs: %s", maxCNAMEDepth, err)
+	}
+	if n := len(m.Answer); n != maxCNAMEDepth+1 {
+		t.Errorf("chain of %d CNAMEs answers %d records, want %d", maxCNAMEDepth, n, maxCNAMEDepth+1)
+	}
+
+	setupTestConf(t, map[string]string{"test.dns-conf": chain(maxCNAMEDepth + 1)})
+	if _, err := query(); err != ErrCNAMELoop {
+		t.Errorf("chain of %d CNAMEs: error %v, want %v", maxCNAMEDepth+1, err, ErrCNAMELoop)
+	}
+
+	setupTestConf(t, map[string]string{"test.dns-conf": "c0.test. 60 IN CNAME c1.test.\nc1.test. 60 IN CNAME c0.test.\n"})
+	if _, err := query(); err != ErrCNAMELoop {
+		t.Errorf("CNAME loop: error %v, want %v", err, ErrCNAMELoop)
+	}
+}
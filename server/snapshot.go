@@ -0,0 +1,178 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rrSnapshot 是本地配置记录的只读快照。快照创建之后不能再修改，
+// 重新加载配置的时候会创建新的快照并原子地替换掉旧的快照，
+// 所以查询的时候不需要加锁。
+type rrSnapshot struct {
+	// 所有配置的记录，name -> [class, type] -> RRs
+	records map[string]map[[2]uint16][]dns.RR
+	// 每个 RRset 的来源，name -> [class, type] -> 来源的名字
+	sources map[string]map[[2]uint16]string
+
+	// 普通域名的记录
+	exact map[string]map[[2]uint16][]dns.RR
+	// 泛解析记录，key 为去掉 "*." 前缀之后的名字
+	wildcards map[string]map[[2]uint16][]dns.RR
+	// 反向解析(in-addr.arpa. 和 ip6.arpa.)的记录
+	reverse map[string]map[[2]uint16][]dns.RR
+	// 所有存在的名字，包括它们的祖先节点(empty non-terminal)，用于泛解析时查找 closest encloser
+	names map[string]struct{}
+	// 权威区域，区域名 -> SOA
+	zones map[string]*dns.SOA
+	// 合并多个 Provider 的记录时的冲突，见 mergeRRsets
+	conflicts []string
+}
+
+// currentRRSnapshot 返回当前使用的本地配置快照
+func currentRRSnapshot() *rrSnapshot {
+	return rrCache.Load().(*rrSnapshot)
+}
+
+// storeRRSnapshot 原子地替换当前使用的本地配置快照
+func storeRRSnapshot(s *rrSnapshot) {
+	rrCache.Store(s)
+}
+
+// newRRSnapshot 用加载好的记录和每个 RRset 的来源创建快照，之后 records 和 sources 不能再修改。
+// authZones 为声明为权威区域的域名。
+func newRRSnapshot(records map[string]map[[2]uint16][]dns.RR, sources map[string]map[[2]uint16]string, authZones []string) *rrSnapshot {
+	s := &rrSnapshot{
+		records:   records,
+		sources:   sources,
+		exact:     map[string]map[[2]uint16][]dns.RR{},
+		wildcards: map[string]map[[2]uint16][]dns.RR{},
+		reverse:   map[string]map[[2]uint16][]dns.RR{},
+		names:     map[string]struct{}{".": {}},
+	}
+	for name, rrsAll := range records {
+		if parent, ok := wildcardParent(name); ok {
+			s.wildcards[parent] = rrsAll
+		} else {
+			s.index(name)[name] = rrsAll
+		}
+		s.addName(name)
+	}
+	s.buildZones(authZones)
+	return s
+}
+
+// index 返回 name 所在的索引，反向解析的域名在 reverse 中，其他的在 exact 中
+func (s *rrSnapshot) index(name string) map[string]map[[2]uint16][]dns.RR {
+	if isReverseName(name) {
+		return s.reverse
+	}
+	return s.exact
+}
+
+// addName 把 name 和它的祖先节点加到 names 中
+func (s *rrSnapshot) addName(name string) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := s.names[name[off:]]; ok {
+			break
+		}
+		s.names[name[off:]] = struct{}{}
+	}
+}
+
+// exists 判断 name 是否存在，包括空的非终结节点
+func (s *rrSnapshot) exists(name string) bool {
+	_, ok := s.names[name]
+	return ok
+}
+
+// lookup 按 RFC 4592 的规则查找 name 的记录，wildcard 表示记录是否来自泛解析。
+func (s *rrSnapshot) lookup(name string) (rrsAll map[[2]uint16][]dns.RR, wildcard, ok bool) {
+	if rrsAll, ok = s.index(name)[name]; ok {
+		return rrsAll, false, true
+	}
+	if s.exists(name) {
+		// 名字存在(包括空的非终结节点)，不能被泛解析匹配；查询 * 本身的时候按普通名字处理
+		if parent, isWildcard := wildcardParent(name); isWildcard {
+			rrsAll, ok = s.wildcards[parent]
+			return rrsAll, false, ok
+		}
+		// 空的非终结节点挡住了祖先节点的泛解析，名字属于本地配置，返回没有记录（NODATA），
+		// 不再查询上游DNS服务器，避免内部的名字泄露出去
+		if s.blocksWildcard(name) {
+			return map[[2]uint16][]dns.RR{}, false, true
+		}
+		return nil, false, false
+	}
+	// 找到最近的存在的祖先节点(closest encloser)，只有它下面的 * 记录能用于泛解析
+	for encloser := name; encloser != "."; {
+		encloser = dnsParent(encloser)
+		if s.exists(encloser) {
+			rrsAll, ok = s.wildcards[encloser]
+			return rrsAll, ok, ok
+		}
+	}
+	return nil, false, false
+}
+
+// blocksWildcard 判断 name 的父节点是否有泛解析记录。
+// 按 RFC 4592，只有最近的存在的祖先节点（closest encloser）下面的 * 记录能匹配，
+// 存在的 name 的 closest encloser 就是父节点，更远的祖先节点的泛解析本来就不能匹配 name
+func (s *rrSnapshot) blocksWildcard(name string) bool {
+	_, ok := s.wildcards[dnsParent(name)]
+	return ok
+}
+
+// countBySource 返回每个来源的记录数
+func (s *rrSnapshot) countBySource() map[string]int {
+	counts := map[string]int{}
+	for name, rrsAll := range s.records {
+		for t, rrs := range rrsAll {
+			counts[s.sources[name][t]] += len(rrs)
+		}
+	}
+	return counts
+}
+
+// countByType 返回每个 [class, type] 的记录数
+func (s *rrSnapshot) countByType() map[[2]uint16]int {
+	counts := map[[2]uint16]int{}
+	for _, rrsAll := range s.records {
+		for t, rrs := range rrsAll {
+			counts[t] += len(rrs)
+		}
+	}
+	return counts
+}
+
+// wildcardParent 返回泛解析记录名 "*.xxx." 所在的父节点 "xxx."
+func wildcardParent(name string) (string, bool) {
+	if name == "*." {
+		return ".", true
+	}
+	if strings.HasPrefix(name, "*.") {
+		return name[2:], true
+	}
+	return "", false
+}
+
+// wildcardName 返回父节点 parent 下的泛解析记录名
+func wildcardName(parent string) string {
+	if parent == "." {
+		return "*."
+	}
+	return "*." + parent
+}
+
+// dnsParent 返回 name 的父节点
+func dnsParent(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 && i+1 < len(name) {
+		return name[i+1:]
+	}
+	return "."
+}
+
+// isReverseName 判断是否为反向解析的域名
+func isReverseName(name string) bool {
+	return strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.")
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"fpdns/lib"
+
+	"github.com/miekg/dns"
+)
+
+func TestMain(m *testing.M) {
+	// 后台的 goroutine 也会打印日志，在所有测试开始之前初始化
+	logInstance = lib.AppLog()
+	logInstance.SetLogLevel(0)
+	// Docker 的事件流断开之后尽快重新连接，run 的 goroutine 不会退出，只能在这里修改
+	dockerRetryInterval = 50 * time.Millisecond
+	// 后台轮询和等待配置变化的 goroutine 也不会退出，同样在这里缩短间隔
+	watchDebounce = 100 * time.Millisecond
+	watchPollInterval = 50 * time.Millisecond
+	// 不真的 ping 上游DNS服务器，见 testPing
+	pingNameserver = testPing
+	os.Exit(m.Run())
+}
+
+// setupTestConf 把 files 写到临时的配置目录中，重置全局的配置状态并加载配置，返回配置目录
+func setupTestConf(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeTestFiles(t, dir, files)
+
+	sc = ServerConfig{ConfDir: dir}
+	registeredProviders = nil
+	providerRRsets = map[string][]RRset{}
+	confHistory = nil
+	lastConfVersion = 0
+	pinnedConfVersion = 0
+	storeRRSnapshot(newRRSnapshot(map[string]map[[2]uint16][]dns.RR{}, nil, nil))
+	// 上游DNS服务器不可用，查询本地配置以外的名字会返回错误
+	resolver.Store(&lib.Resolver{Config: &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: "1", Timeout: 1}})
+	loadConf()
+	return dir
+}
+
+// writeTestFiles 把 files 写到 dir 中，key 为相对路径
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testSnapshot 用区域文件格式的记录创建快照
+func testSnapshot(t *testing.T, lines ...string) *rrSnapshot {
+	t.Helper()
+	records := map[string]map[[2]uint16][]dns.RR{}
+	for _, line := range lines {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatalf("bad record %q: %s", line, err)
+		}
+		rr.Header().Name = normalizeName(rr.Header().Name)
+		addRecord(records, rr)
+	}
+	return newRRSnapshot(records, nil, nil)
+}
+
+// testQuery 查询 name 的 qtype 记录
+func testQuery(t *testing.T, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	m, err := queryDnsResult("udp", r, 0)
+	if err != nil {
+		t.Fatalf("query %s %s: %s", name, dns.TypeToString[qtype], err)
+	}
+	return m
+}
+
+func TestSnapshotLookup(t *testing.T) {
+	s := testSnapshot(t,
+		"*.example. 60 IN A 10.0.0.1",
+		"x.example. 60 IN A 10.0.0.2",
+		"a.b.example. 60 IN A 10.0.0.3",
+		"*.c.example. 60 IN TXT \"c\"",
+		"k.c.example. 60 IN A 10.0.0.4",
+		"a.b.x.example. 60 IN A 10.0.0.5",
+	)
+
+	tests := []struct {
+		desc     string
+		name     string
+		ok       bool
+		wildcard bool
+		// 期望的记录类型，nil 表示没有记录
+		types []uint16
+	}{
+		{"explicit name", "x.example.", true, false, []uint16{dns.TypeA}},
+		{"wildcard match", "q.example.", true, true, []uint16{dns.TypeA}},
+		{"wildcard matches deeper names", "p.q.example.", true, true, []uint16{dns.TypeA}},
+		{"wildcard blocked by explicit name", "y.x.example.", false, false, nil},
+		{"empty non-terminal below explicit name", "b.x.example.", false, false, nil},
+		{"wildcard blocked by empty non-terminal", "b.example.", true, false, nil},
+		{"below empty non-terminal", "z.b.example.", false, false, nil},
+		{"closest encloser selects nearest wildcard", "m.c.example.", true, true, []uint16{dns.TypeTXT}},
+		{"closest encloser below explicit name", "n.k.c.example.", false, false, nil},
+		{"wildcard owner itself", "*.example.", true, false, []uint16{dns.TypeA}},
+		{"outside configured names", "example.org.", false, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			rrsAll, wildcard, ok := s.lookup(tt.name)
+			if ok != tt.ok || wildcard != tt.wildcard {
+				t.Fatalf("lookup(%s) = wildcard %t, ok %t, want wildcard %t, ok %t", tt.name, wildcard, ok, tt.wildcard, tt.ok)
+			}
+			if len(rrsAll) != len(tt.types) {
+				t.Fatalf("lookup(%s) returns %d rrsets, want %d", tt.name, len(rrsAll), len(tt.types))
+			}
+			for _, qtype := range tt.types {
+				if len(rrsAll[[2]uint16{dns.ClassINET, qtype}]) == 0 {
+					t.Errorf("lookup(%s) has no %s records", tt.name, dns.TypeToString[qtype])
+				}
+			}
+		})
+	}
+}
+
+func TestQueryNODATA(t *testing.T) {
+	setupTestConf(t, map[string]string{
+		"test.dns-conf": "*.example. 60 IN A 10.0.0.1\nx.example. 60 IN A 10.0.0.2\na.b.example. 60 IN A 10.0.0.3\n",
+	})
+
+	tests := []struct {
+		desc  string
+		name  string
+		qtype uint16
+	}{
+		{"name exists without the type", "x.example.", dns.TypeTXT},
+		{"wildcard without the type", "q.example.", dns.TypeMX},
+		{"empty non-terminal blocking a wildcard", "b.example.", dns.TypeA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			m := testQuery(t, tt.name, tt.qtype)
+			if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+				t.Errorf("query %s %s = %s with %d answers, want NODATA",
+					tt.name, dns.TypeToString[tt.qtype], dns.RcodeToString[m.Rcode], len(m.Answer))
+			}
+		})
+	}
+}
+
+// TestQueryDuringReload 在并发查询的同时不断重新加载配置，需要用 -race 运行
+func TestQueryDuringReload(t *testing.T) {
+	confContent := func(i int) string {
+		return fmt.Sprintf("a.example. 60 IN A 10.0.0.%d\n*.example. 60 IN A 10.0.1.%d\nc.example. 60 IN CNAME a.example.\n", i%2+1, i%2+1)
+	}
+	dir := setupTestConf(t, map[string]string{"test.dns-conf": confContent(0)})
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, name := range []string{"a.example.", "w.example.", "c.example."} {
+					r := new(dns.Msg)
+					r.SetQuestion(name, dns.TypeA)
+					m, err := queryDnsResult("udp", r, 0)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if len(m.Answer) == 0 {
+						errs <- fmt.Errorf("no answer for %s", name)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 50; i++ {
+		writeTestFiles(t, dir, map[string]string{"test.dns-conf": confContent(i)})
+		if _, _, err := reloadDNSConf("test", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	m := testQuery(t, "a.example.", dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("answer after reloads = %v, want 10.0.0.1", m.Answer)
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// 配置文件变化之后等待的时间，这段时间内的多次变化(例如 git pull)只会重新加载一次
+	watchDebounce = 2 * time.Second
+	// 不支持 inotify 的时候轮询配置目录的间隔，也是轮询单独的文件的间隔
+	watchPollInterval = 5 * time.Second
+)
+
+// watchConfDirs 监听配置目录中文件的创建、修改、重命名和删除，有变化的时候自动重新加载配置。
+// 目录优先使用 inotify，不支持的时候使用轮询。files 中不在这些目录中的文件（例如 -hosts_file
+// 指定的 /etc/hosts）单独轮询，避免监听整个 /etc 目录。
+func watchConfDirs(dirs, files []string) {
+	changes := make(chan struct{}, 1)
+	changed := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+
+	for _, dir := range dirs {
+		if err := startInotifyWatcher(dir, changed); err != nil {
+			logInstance.Noticef("watch conf dir [%s] with inotify failed: %s, fallback to polling\n", dir, err)
+			go pollConfDir(dir, changed)
+		}
+	}
+	for _, path := range filesOutsideDirs(files, dirs) {
+		go pollFile(path, changed)
+	}
+	// resolv.conf 在配置文件重新加载成功之后再重新加载，见 reloadNotifiedProvider
+	go reloadOnChange(changes, func() { confFiles.notify("conf dir changed") })
+}
+
+// filesOutsideDirs 返回 files 中不在 dirs 中的任何一个目录（包括子目录）里面的文件
+func filesOutsideDirs(files, dirs []string) []string {
+	var outside []string
+	for _, path := range files {
+		path = filepath.Clean(path)
+		inside := false
+		for _, dir := range dirs {
+			if strings.HasPrefix(path, filepath.Clean(dir)+string(filepath.Separator)) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			outside = append(outside, path)
+		}
+	}
+	return outside
+}
+
+// reloadOnChange 收到配置变化的通知后，等待 watchDebounce 没有新的变化再调用 reload
+func reloadOnChange(changes <-chan struct{}, reload func()) {
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	// pending 表示 timer 在计时，并且还没有从 timer.C 读取到期的时间
+	pending := false
+	for {
+		select {
+		case <-changes:
+			// timer 已经到期但是还没有读取的时候需要先读取，否则 Reset 之后会马上触发
+			if !timer.Stop() && pending {
+				<-timer.C
+			}
+			timer.Reset(watchDebounce)
+			pending = true
+		case <-timer.C:
+			pending = false
+			reload()
+		}
+	}
+}
+
+// reloadDNSConfAndLog 重新加载 providers 的记录，没有指定的时候重新加载所有 Provider 的记录，
+// 把重新加载的原因和记录的变化打印到日志中。严格模式下加载出错的时候返回 false。
+func reloadDNSConfAndLog(reason string, providers ...Provider) bool {
+	diff, _, err := reloadDNSConf(reason, false, providers...)
+	if err != nil {
+		logInstance.Errorf("%s, reload dns conf aborted in strict mode, keep using the old conf:\n%s\n", reason, err)
+		return false
+	}
+	logInstance.Logf("%s, reload dns conf done. %s\n", reason, diff.summary())
+	for _, rrset := range diff {
+		for _, rr := range rrset.Removed {
+			logInstance.Debugf("dns conf delete %s\n", rr)
+		}
+		for _, rr := range rrset.Added {
+			logInstance.Debugf("dns conf add %s\n", rr)
+		}
+	}
+	return true
+}
+
+// ignoreWatchName 忽略 .git 目录和编辑器的临时文件。
+// 其他文件都需要监听，因为 $INCLUDE 的文件可以是任意的后缀，
+// 而 k8s 的 ConfigMap 是通过替换 ..data 目录的软链接来更新文件的。
+func ignoreWatchName(name string) bool {
+	name = filepath.Base(name)
+	return name == ".git" || strings.HasSuffix(name, "~") ||
+		strings.HasSuffix(name, ".swp") || strings.HasSuffix(name, ".swx")
+}
+
+type pollFileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// pollConfDir 定期检查配置目录中文件的大小和修改时间，有变化的时候调用 changed
+func pollConfDir(dir string, changed func()) {
+	last := pollConfDirState(dir)
+	for {
+		time.Sleep(watchPollInterval)
+		current := pollConfDirState(dir)
+		if len(current) != len(last) {
+			changed()
+		} else {
+			for path, state := range current {
+				if last[path] != state {
+					changed()
+					break
+				}
+			}
+		}
+		last = current
+	}
+}
+
+// pollFile 定期检查文件的大小和修改时间，有变化的时候调用 changed
+func pollFile(path string, changed func()) {
+	last := pollFileStateOf(path)
+	for {
+		time.Sleep(watchPollInterval)
+		if current := pollFileStateOf(path); current != last {
+			last = current
+			changed()
+		}
+	}
+}
+
+// pollFileStateOf 返回文件的大小和修改时间，文件不存在的时候返回零值
+func pollFileStateOf(path string) pollFileState {
+	if fi, err := os.Stat(path); err == nil {
+		return pollFileState{fi.Size(), fi.ModTime()}
+	}
+	return pollFileState{}
+}
+
+func pollConfDirState(dir string) map[string]pollFileState {
+	states := map[string]pollFileState{}
+	filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if f == nil {
+			return nil
+		}
+		if ignoreWatchName(path) {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if f.IsDir() {
+			return nil
+		}
+		// 使用 os.Stat 跟随软链接
+		if fi, err := os.Stat(path); err == nil {
+			states[path] = pollFileState{fi.Size(), fi.ModTime()}
+		}
+		return nil
+	})
+	return states
+}
@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ATTRIB | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// inotifyWatcher 用 inotify 监听配置目录和所有的子目录
+type inotifyWatcher struct {
+	fd int
+	// watch descriptor -> 目录
+	dirs map[int]string
+}
+
+// startInotifyWatcher 开始用 inotify 监听 dir，有变化的时候调用 changed
+func startInotifyWatcher(dir string, changed func()) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	w := &inotifyWatcher{fd: fd, dirs: map[int]string{}}
+	if err := w.addDir(dir); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	go w.loop(changed)
+	return nil
+}
+
+// addDir 监听 dir 和它所有的子目录
+func (w *inotifyWatcher) addDir(dir string) error {
+	return filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if f == nil || !f.IsDir() {
+			return nil
+		}
+		if path != dir && ignoreWatchName(path) {
+			return filepath.SkipDir
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			return err
+		}
+		w.dirs[wd] = path
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) loop(changed func()) {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			logInstance.Errorf("read inotify events error: %s\n", err)
+			return
+		}
+
+		notify := false
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			name := string(nameBytes)
+			for i := 0; i < len(name); i++ {
+				if name[i] == 0 {
+					name = name[:i]
+					break
+				}
+			}
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				notify = true
+				continue
+			}
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(w.dirs, int(event.Wd))
+				continue
+			}
+			dir, ok := w.dirs[int(event.Wd)]
+			if !ok || (name != "" && ignoreWatchName(name)) {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				// 新的子目录
+				if err := w.addDir(path); err != nil {
+					logInstance.Warnf("watch conf dir [%s] error: %s\n", path, err)
+				}
+			}
+			notify = true
+		}
+		if notify {
+			changed()
+		}
+	}
+}
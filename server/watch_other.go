@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "errors"
+
+// startInotifyWatcher 只有 linux 支持 inotify，其他系统使用轮询
+func startInotifyWatcher(dir string, changed func()) error {
+	return errors.New("inotify is not supported on this platform")
+}
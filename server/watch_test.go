@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestStrictWatchKeepsNameservers 严格模式下 -watch_conf 触发的重新加载出错的时候不重新加载 resolv.conf
+func TestStrictWatchKeepsNameservers(t *testing.T) {
+	dir := setupTestConf(t, map[string]string{
+		"test.dns-conf": "a.example. IN A 10.0.0.1\n",
+		"resolv.conf":   "nameserver 192.0.2.1\n",
+	})
+	defer setNameservers()
+	setNameservers("192.0.2.1")
+	sc.StrictReload = true
+
+	writeTestFiles(t, dir, map[string]string{
+		"test.dns-conf": "a.example. IN A 10.0.0.2\nbad.example. IN A 10.0.0.300\n",
+		"resolv.conf":   "nameserver 192.0.2.2\n",
+	})
+	reloadNotifiedProvider(confFiles, "conf dir changed")
+	if got := currentResolver().Nameservers(); !reflect.DeepEqual(got, []string{"192.0.2.1:53"}) {
+		t.Errorf("nameservers after a strict conf error = %v, want [192.0.2.1:53]", got)
+	}
+	if ip := answerA(t, "a.example."); ip != "10.0.0.1" {
+		t.Errorf("a.example. = %s after a strict conf error, want 10.0.0.1", ip)
+	}
+
+	// 修复配置之后一起重新加载
+	writeTestFiles(t, dir, map[string]string{"test.dns-conf": "a.example. IN A 10.0.0.2\n"})
+	reloadNotifiedProvider(confFiles, "conf dir changed")
+	if got := currentResolver().Nameservers(); !reflect.DeepEqual(got, []string{"192.0.2.2:53"}) {
+		t.Errorf("nameservers after the conf is fixed = %v, want [192.0.2.2:53]", got)
+	}
+	if ip := answerA(t, "a.example."); ip != "10.0.0.2" {
+		t.Errorf("a.example. = %s after the conf is fixed, want 10.0.0.2", ip)
+	}
+}
+
+// TestReloadOnChange 连续的多次变化只在最后一次变化 watchDebounce 之后重新加载一次
+func TestReloadOnChange(t *testing.T) {
+	changes := make(chan struct{}, 1)
+	var reloads int64
+	go reloadOnChange(changes, func() { atomic.AddInt64(&reloads, 1) })
+
+	// 每次变化的间隔都小于 watchDebounce，总的时间大于 watchDebounce
+	for i := 0; i < 5; i++ {
+		changes <- struct{}{}
+		time.Sleep(watchDebounce / 4)
+	}
+	if n := atomic.LoadInt64(&reloads); n != 0 {
+		t.Fatalf("reloads during changes = %d, want 0", n)
+	}
+	waitFor(t, "reload after changes", func() bool { return atomic.LoadInt64(&reloads) == 1 })
+	time.Sleep(3 * watchDebounce)
+	if n := atomic.LoadInt64(&reloads); n != 1 {
+		t.Fatalf("reloads after changes = %d, want 1", n)
+	}
+
+	changes <- struct{}{}
+	waitFor(t, "reload after another change", func() bool { return atomic.LoadInt64(&reloads) == 2 })
+}
+
+func TestPollConfDirState(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"a.dns-conf":     "a",
+		"sub/b.dns-conf": "bb",
+		"a.dns-conf.swp": "ignored",
+		".git/HEAD":      "ignored",
+		"zones/c.zone":   "ccc",
+		"zones/c.zone~":  "ignored",
+	})
+	if err := os.Symlink(filepath.Join(dir, "zones", "c.zone"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	states := pollConfDirState(dir)
+	for path, state := range states {
+		rel, _ := filepath.Rel(dir, path)
+		got = append(got, fmt.Sprintf("%s %d", rel, state.size))
+	}
+	sort.Strings(got)
+	// 软链接按照它指向的文件计算
+	want := []string{"a.dns-conf 1", "link 3", "sub/b.dns-conf 2", "zones/c.zone 3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("states = %v, want %v", got, want)
+	}
+}
+
+// TestPollConfDir 轮询的时候发现文件的修改、增加和删除，忽略编辑器的临时文件
+func TestPollConfDir(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{"a.dns-conf": "a"})
+	var changes int64
+	go pollConfDir(dir, func() { atomic.AddInt64(&changes, 1) })
+	time.Sleep(watchPollInterval / 2)
+
+	steps := []struct {
+		desc   string
+		change func()
+	}{
+		{"modify", func() { writeTestFiles(t, dir, map[string]string{"a.dns-conf": "aa"}) }},
+		{"add", func() { writeTestFiles(t, dir, map[string]string{"sub/b.dns-conf": "b"}) }},
+		{"remove", func() { os.Remove(filepath.Join(dir, "sub/b.dns-conf")) }},
+	}
+	for i, step := range steps {
+		step.change()
+		want := int64(i + 1)
+		waitFor(t, step.desc, func() bool { return atomic.LoadInt64(&changes) == want })
+	}
+
+	writeTestFiles(t, dir, map[string]string{"a.dns-conf.swp": "x", "a.dns-conf~": "x"})
+	time.Sleep(3 * watchPollInterval)
+	if n := atomic.LoadInt64(&changes); n != int64(len(steps)) {
+		t.Errorf("changes after writing temp files = %d, want %d", n, len(steps))
+	}
+}
+
+// TestPollFile 配置目录以外的 -hosts_file 单独轮询
+func TestPollFile(t *testing.T) {
+	confDir, etc := t.TempDir(), t.TempDir()
+	hosts := filepath.Join(etc, "hosts")
+	files := []string{hosts, filepath.Join(confDir, "hosts"), filepath.Join(confDir, "sub", "x.hosts")}
+	if got := filesOutsideDirs(files, []string{confDir + "/"}); !reflect.DeepEqual(got, []string{hosts}) {
+		t.Errorf("files outside conf dir = %v, want [%s]", got, hosts)
+	}
+	if got := filesOutsideDirs([]string{confDir + "x/hosts"}, []string{confDir}); len(got) != 1 {
+		t.Errorf("file in a sibling dir with the same prefix is not polled: %v", got)
+	}
+
+	writeTestFiles(t, etc, map[string]string{"hosts": "10.0.0.1 a.test\n"})
+	var changes int64
+	go pollFile(hosts, func() { atomic.AddInt64(&changes, 1) })
+	time.Sleep(watchPollInterval / 2)
+
+	writeTestFiles(t, etc, map[string]string{"hosts": "10.0.0.2 a.test\n10.0.0.3 b.test\n"})
+	waitFor(t, "hosts file modified", func() bool { return atomic.LoadInt64(&changes) == 1 })
+	os.Remove(hosts)
+	waitFor(t, "hosts file removed", func() bool { return atomic.LoadInt64(&changes) == 2 })
+	writeTestFiles(t, etc, map[string]string{"hosts": "10.0.0.1 a.test\n"})
+	waitFor(t, "hosts file created", func() bool { return atomic.LoadInt64(&changes) == 3 })
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// 合成的 SOA 和 NS 记录使用的参数，和 BIND 的空区域(empty zones)一样
+const (
+	synthesizedNS      = "localhost."
+	synthesizedMbox    = "nobody.localhost."
+	synthesizedTTL     = 3600
+	synthesizedRefresh = 28800
+	synthesizedRetry   = 7200
+	synthesizedExpire  = 604800
+	synthesizedMinTTL  = 60
+)
+
+// buildZones 找出所有的权威区域：配置了 SOA 记录的名字，以及 authZones 中声明的区域。
+// authZones 中没有配置 SOA 的区域会合成 SOA 记录，不管 SOA 是配置的还是合成的，
+// 没有配置 NS 的区域都会合成 NS 记录。合成的记录只加到查询用的索引中，不会出现在 records 里面。
+func (s *rrSnapshot) buildZones(authZones []string) {
+	s.zones = map[string]*dns.SOA{}
+	for name, rrsAll := range s.records {
+		rrs := rrsAll[[2]uint16{dns.ClassINET, dns.TypeSOA}]
+		if len(rrs) > 0 {
+			s.zones[name] = rrs[0].(*dns.SOA)
+		}
+	}
+
+	serial := uint32(time.Now().Unix())
+	for _, zone := range authZones {
+		zone = strings.ToLower(dns.Fqdn(zone))
+		if _, ok := s.zones[zone]; ok {
+			continue
+		}
+		soa := &dns.SOA{
+			Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: synthesizedTTL},
+			Ns:      synthesizedNS,
+			Mbox:    synthesizedMbox,
+			Serial:  serial,
+			Refresh: synthesizedRefresh,
+			Retry:   synthesizedRetry,
+			Expire:  synthesizedExpire,
+			Minttl:  synthesizedMinTTL,
+		}
+		s.addSynthesized(zone, soa)
+		s.zones[zone] = soa
+	}
+
+	for zone := range s.zones {
+		if len(s.index(zone)[zone][[2]uint16{dns.ClassINET, dns.TypeNS}]) == 0 {
+			s.addSynthesized(zone, &dns.NS{
+				Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: synthesizedTTL},
+				Ns:  synthesizedNS,
+			})
+		}
+	}
+}
+
+// addSynthesized 把合成的记录加到查询用的索引中，替换 name 原来的同类型的记录。
+// 会复制一份 name 的记录，不修改 records 中的数据。
+func (s *rrSnapshot) addSynthesized(name string, rr dns.RR) {
+	index := s.index(name)
+	rrsAll := map[[2]uint16][]dns.RR{}
+	for t, rrs := range index[name] {
+		rrsAll[t] = rrs
+	}
+	rrsAll[[2]uint16{rr.Header().Class, rr.Header().Rrtype}] = []dns.RR{rr}
+	index[name] = rrsAll
+	s.addName(name)
+}
+
+// findZone 返回 name 所在的权威区域的 SOA 记录，不在权威区域内返回 nil
+func (s *rrSnapshot) findZone(name string) *dns.SOA {
+	if len(s.zones) == 0 {
+		return nil
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if soa, ok := s.zones[name[off:]]; ok {
+			return soa
+		}
+	}
+	return s.zones["."]
+}
+
+// negativeSOA 返回否定应答的 authority 中使用的 SOA 记录，
+// TTL 为 SOA 记录的 TTL 和 MINIMUM 中较小的值(RFC 2308)
+func negativeSOA(soa *dns.SOA) dns.RR {
+	rr := dns.Copy(soa)
+	if soa.Minttl < rr.Header().Ttl {
+		rr.Header().Ttl = soa.Minttl
+	}
+	return rr
+}
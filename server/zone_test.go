@@ -0,0 +1,49 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBuildZonesApexNS(t *testing.T) {
+	records := map[string]map[[2]uint16][]dns.RR{}
+	for _, line := range []string{
+		"soa-only.example. 60 IN SOA ns.soa-only.example. admin.soa-only.example. 1 3600 600 86400 60",
+		"with-ns.example. 60 IN SOA ns.with-ns.example. admin.with-ns.example. 1 3600 600 86400 60",
+		"with-ns.example. 60 IN NS ns.with-ns.example.",
+		"declared.example. 60 IN A 10.0.0.1",
+	} {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addRecord(records, rr)
+	}
+	s := newRRSnapshot(records, nil, []string{"declared.example", "empty.example."})
+
+	tests := []struct {
+		zone string
+		ns   string
+	}{
+		{"soa-only.example.", synthesizedNS},
+		{"with-ns.example.", "ns.with-ns.example."},
+		{"declared.example.", synthesizedNS},
+		{"empty.example.", synthesizedNS},
+	}
+	for _, tt := range tests {
+		if s.findZone(tt.zone) == nil {
+			t.Errorf("%s is not a zone", tt.zone)
+			continue
+		}
+		rrsAll, _, ok := s.lookup(tt.zone)
+		nss := rrsAll[[2]uint16{dns.ClassINET, dns.TypeNS}]
+		if !ok || len(nss) != 1 || nss[0].(*dns.NS).Ns != tt.ns {
+			t.Errorf("NS of %s = %v, want %s", tt.zone, nss, tt.ns)
+		}
+	}
+	// 合成的记录不修改 records
+	if _, ok := records["soa-only.example."][[2]uint16{dns.ClassINET, dns.TypeNS}]; ok {
+		t.Errorf("synthesized NS is added to records")
+	}
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultConfTTL 是没有指定 TTL 也没有 $TTL 指令时使用的 TTL，和 dns.NewRR 的默认值一样
+	defaultConfTTL = 3600
+	// maxConfIncludeDepth 是 $INCLUDE 最多嵌套的层数，和 dns 库一样
+	maxConfIncludeDepth = 7
+)
+
+// parseDNSConf 按 RFC 1035 第5节的 master file 格式解析 .dns-conf 配置文件，
+// 支持 $ORIGIN、$TTL、$INCLUDE、$GENERATE、@、相对域名和用括号分成多行的记录。
+// 以 # 开头的行也当作注释。data 为文件 path 的内容。
+// $INCLUDE 的相对路径相对于 confDir，confDir 为空的时候（远程配置）不允许使用 $INCLUDE。
+//
+// 解析出错的时候跳过出错的行继续解析后面的内容，返回的错误里面包含了文件名和行号，
+// $INCLUDE 的文件中的错误使用被包含的文件的文件名和行号。
+//
+// 另外支持 fpdns 自定义的指令，见 dnsConfOptions。
+func parseDNSConf(confDir, path string, data []byte) (rrs []dns.RR, opts dnsConfOptions, errs []error) {
+	rrs, errs = parseConfFile(confDir, path, data, confParseState{origin: "."}, 0, &opts)
+	return
+}
+
+// confParseState 是解析到某一行的时候 $ORIGIN 和 $TTL 指令的值，ttl 为空表示还没有 $TTL 指令
+type confParseState struct {
+	origin string
+	ttl    string
+}
+
+// confInclude 是一条 $INCLUDE 指令，line 为所在的行（从0开始）
+type confInclude struct {
+	line   int
+	fields []string
+}
+
+// parseConfFile 解析一个配置文件或者被 $INCLUDE 的文件，state 为文件开始的时候 $ORIGIN 和 $TTL 的值，
+// 文件中的 $ORIGIN 和 $TTL 指令只对这个文件后面的内容生效，depth 为 $INCLUDE 嵌套的层数。
+func parseConfFile(confDir, path string, data []byte, state confParseState, depth int, opts *dnsConfOptions) (rrs []dns.RR, errs []error) {
+	lines := strings.Split(string(data), "\n")
+	// states[i] 为第 i 行之前的 $ORIGIN 和 $TTL，跳过出错的行之后从这个状态继续解析
+	states := make([]confParseState, len(lines))
+	var includes []confInclude
+	for i, line := range lines {
+		states[i] = state
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			lines[i] = ""
+			continue
+		}
+		fields := confLineFields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "$AUTO_PTR":
+			if err := opts.setAutoPTR(fields[1:]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s at line: %d", path, err, i+1))
+			}
+			lines[i] = ""
+		case "$INCLUDE":
+			// 由 includeConf 解析，这样被包含的文件也能使用 $TTL 和 # 注释
+			includes = append(includes, confInclude{i, fields})
+			lines[i] = ""
+		case "$ORIGIN":
+			if len(fields) == 2 {
+				if origin, ok := absoluteConfName(fields[1], state.origin); ok {
+					state.origin = origin
+				}
+			}
+		case "$TTL":
+			if len(fields) == 2 {
+				if ttl, ok := parseTTLDirective(fields[1]); ok {
+					state.ttl = strconv.FormatUint(uint64(ttl), 10)
+				}
+			}
+		case "$GENERATE":
+			// dns 库展开 $GENERATE 的时候不使用 $TTL 的值，没有指定 TTL 的时候需要把 $TTL 的值加上，
+			// 格式为 $GENERATE range lhs [ttl] [class] type rhs
+			if len(fields) > 4 && state.ttl != "" && !generateHasTTL(fields) {
+				fields = append(fields[:3], append([]string{state.ttl}, fields[3:]...)...)
+				lines[i] = strings.Join(fields, " ")
+			}
+		}
+	}
+
+	text := strings.Join(lines, "\n")
+	// lineStart[i] 为第 i 行在 text 中的位置，lineStart[len(lines)] 为 text 的长度加1
+	lineStart := make([]int, len(lines)+1)
+	for i, line := range lines {
+		lineStart[i+1] = lineStart[i] + len(line) + 1
+	}
+
+	// 按 $INCLUDE 指令把文件分成多段依次解析，保持记录的顺序
+	start := 0
+	for _, inc := range append(includes, confInclude{line: len(lines)}) {
+		if inc.line > start {
+			segRRs, segErrs := parseConfLines(path, text[lineStart[start]:lineStart[inc.line]-1], start, states)
+			rrs = append(rrs, segRRs...)
+			errs = append(errs, segErrs...)
+		}
+		if inc.fields != nil {
+			incRRs, incErrs := includeConf(confDir, path, inc, states[inc.line], depth, opts)
+			rrs = append(rrs, incRRs...)
+			errs = append(errs, incErrs...)
+		}
+		start = inc.line + 1
+	}
+	return
+}
+
+// parseConfLines 解析从第 first 行（从0开始）开始的 text。出错的时候跳过出错的行，
+// 用 states 中保存的 $ORIGIN 和 $TTL 从下一行继续解析，每一行只解析一次。
+func parseConfLines(path, text string, first int, states []confParseState) (rrs []dns.RR, errs []error) {
+	line := first
+	for {
+		state := states[line]
+		prefix, prefixLines := "", 0
+		if state.ttl != "" {
+			prefix, prefixLines = "$TTL "+state.ttl+"\n", 1
+		}
+		lr := &lineCountReader{r: bufio.NewReader(io.MultiReader(strings.NewReader(prefix), strings.NewReader(text)))}
+		zp := dns.NewZoneParser(lr, state.origin, path)
+		zp.SetDefaultTTL(defaultConfTTL)
+		// dns 库返回的行号加上 delta 为文件中的行号
+		delta := line - prefixLines
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			if rr.Header().Name == "" {
+				// 跳过出错的行之后，续行的记录可能没有记录名
+				errs = append(errs, fmt.Errorf("%s: dns: missing owner name: %q at line: %d", path, rr.String(), lr.lines+delta))
+				continue
+			}
+			rrs = append(rrs, rr)
+		}
+		err := zp.Err()
+		if err == nil {
+			return
+		}
+		errs = append(errs, shiftErrorLine(err, delta))
+
+		// 从出错的行的下一行继续解析，dns 库可能已经读取了出错的行后面的内容，所以优先使用错误中的行号
+		skipped := lr.lines - prefixLines
+		if lr.last != '\n' {
+			skipped++
+		}
+		if l := errorLine(err); l > 0 {
+			skipped = l + delta - line
+		}
+		if skipped < 1 {
+			skipped = 1
+		}
+		for ; skipped > 0; skipped-- {
+			i := strings.IndexByte(text, '\n')
+			if i < 0 {
+				return
+			}
+			text = text[i+1:]
+			line++
+		}
+	}
+}
+
+// includeConf 解析 $INCLUDE 指令包含的文件，格式为 $INCLUDE 文件名 [origin]。
+// 被包含的文件继承当前的 $ORIGIN 和 $TTL。
+func includeConf(confDir, path string, inc confInclude, state confParseState, depth int, opts *dnsConfOptions) ([]dns.RR, []error) {
+	fail := func(msg string) ([]dns.RR, []error) {
+		return nil, []error{fmt.Errorf("%s: dns: %s at line: %d", path, msg, inc.line+1)}
+	}
+	switch {
+	case confDir == "":
+		return fail("$INCLUDE directive not allowed")
+	case len(inc.fields) < 2 || len(inc.fields) > 3:
+		return fail("bad $INCLUDE directive")
+	case depth >= maxConfIncludeDepth:
+		return fail("too deeply nested $INCLUDE")
+	}
+	if len(inc.fields) == 3 {
+		origin, ok := absoluteConfName(inc.fields[2], state.origin)
+		if !ok {
+			return fail("bad origin name in $INCLUDE")
+		}
+		state.origin = origin
+	}
+
+	includePath := inc.fields[1]
+	if !filepath.IsAbs(includePath) {
+		includePath = filepath.Join(confDir, includePath)
+	}
+	data, err := ioutil.ReadFile(includePath)
+	if err != nil {
+		return fail(err.Error())
+	}
+	return parseConfFile(confDir, includePath, data, state, depth+1, opts)
+}
+
+// confLineFields 返回一行中 ; 注释之前的字段
+func confLineFields(line string) []string {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.Fields(line)
+}
+
+// absoluteConfName 把 $ORIGIN 和 $INCLUDE 指令中的域名转换为完整的域名，相对域名相对于 origin
+func absoluteConfName(name, origin string) (string, bool) {
+	if name == "@" {
+		return origin, true
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", false
+	}
+	if dns.IsFqdn(name) {
+		return name, true
+	}
+	if origin == "." {
+		return name + ".", true
+	}
+	return name + "." + origin, true
+}
+
+// parseTTLDirective 用 dns 库解析 $TTL 指令的值，支持 1h30m 这样的格式
+func parseTTLDirective(s string) (uint32, bool) {
+	rr, err := dns.NewRR("$TTL " + s + "\n. A 0.0.0.0")
+	if err != nil || rr == nil {
+		return 0, false
+	}
+	return rr.Header().Ttl, true
+}
+
+// parseErrorLineRE 匹配 dns 库的解析错误最后的 "at line: 行:列"
+var parseErrorLineRE = regexp.MustCompile(`at line: (\d+):\d+$`)
+
+// errorLine 返回 dns 库的解析错误中的行号，没有行号的时候返回0
+func errorLine(err error) int {
+	m := parseErrorLineRE.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(m[1])
+	return line
+}
+
+// shiftErrorLine 把 dns 库的解析错误中的行号加上 delta
+func shiftErrorLine(err error, delta int) error {
+	msg := err.Error()
+	m := parseErrorLineRE.FindStringSubmatchIndex(msg)
+	if m == nil || delta == 0 {
+		return err
+	}
+	line, _ := strconv.Atoi(msg[m[2]:m[3]])
+	return errors.New(msg[:m[2]] + strconv.Itoa(line+delta) + msg[m[3]:])
+}
+
+// dnsConfOptions 是 .dns-conf 文件中 fpdns 自定义指令的设置，对整个文件生效
+type dnsConfOptions struct {
+	// $AUTO_PTR on|off: 是否为文件中的 A 和 AAAA 记录自动生成 PTR 记录，nil 表示使用全局的设置
+	autoPTR *bool
+}
+
+func (o *dnsConfOptions) setAutoPTR(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("$AUTO_PTR expects on or off")
+	}
+	switch strings.ToLower(args[0]) {
+	case "on":
+		v := true
+		o.autoPTR = &v
+	case "off":
+		v := false
+		o.autoPTR = &v
+	default:
+		return fmt.Errorf("$AUTO_PTR expects on or off, not %q", args[0])
+	}
+	return nil
+}
+
+// generateHasTTL 判断 $GENERATE 指令是否指定了 TTL，TTL 可以在 class 的前面或者后面
+func generateHasTTL(fields []string) bool {
+	if isDigit(fields[3][0]) {
+		return true
+	}
+	_, isClass := dns.StringToClass[strings.ToUpper(fields[3])]
+	return isClass && isDigit(fields[4][0])
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// lineCountReader 统计已经读取的行数，用于在解析出错的时候找到出错的行
+type lineCountReader struct {
+	r     io.ByteReader
+	lines int
+	last  byte
+}
+
+func (r *lineCountReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.last = b
+		if b == '\n' {
+			r.lines++
+		}
+	}
+	return b, err
+}
+
+func (r *lineCountReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		p[n], err = r.ReadByte()
+		if err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// errorLines 返回错误信息中 "at line: " 后面的行号
+func errorLines(t *testing.T, errs []error) []string {
+	t.Helper()
+	var lines []string
+	for _, err := range errs {
+		msg := err.Error()
+		i := strings.LastIndex(msg, "at line: ")
+		if i < 0 {
+			t.Fatalf("error without line number: %s", msg)
+		}
+		line := msg[i+len("at line: "):]
+		if j := strings.IndexByte(line, ':'); j >= 0 {
+			line = line[:j]
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestParseDNSConfRecovery(t *testing.T) {
+	conf := strings.Join([]string{
+		"$TTL 600",                  // 1
+		"$ORIGIN example.",          // 2
+		"a IN A 10.0.0.1",           // 3
+		"b IN A 10.0.0.300",         // 4 bad
+		"c IN A 10.0.0.3",           // 5
+		"# comment",                 // 6
+		"d IN BADTYPE x",            // 7 bad
+		"$ORIGIN sub",               // 8
+		"e 60 IN A 10.0.0.5",        // 9
+		"f IN MX (",                 // 10
+		"  10 mail )",               // 11
+		"g IN A",                    // 12 bad
+		"h IN TXT \"after errors\"", // 13
+	}, "\n")
+	rrs, _, errs := parseDNSConf("", "test.dns-conf", []byte(conf))
+
+	if got, want := errorLines(t, errs), []string{"4", "7", "12"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("error lines = %v, want %v: %v", got, want, errs)
+	}
+	want := []string{
+		"a.example.\t600\tIN\tA\t10.0.0.1",
+		"c.example.\t600\tIN\tA\t10.0.0.3",
+		"e.sub.example.\t60\tIN\tA\t10.0.0.5",
+		"f.sub.example.\t600\tIN\tMX\t10 mail.sub.example.",
+		"h.sub.example.\t600\tIN\tTXT\t\"after errors\"",
+	}
+	var got []string
+	for _, rr := range rrs {
+		got = append(got, rr.String())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("records =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseDNSConfManyErrors(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b, "bad%d.example. IN A 10.0.0.300\ngood%d.example. IN A 10.0.0.1\n", i, i)
+	}
+	rrs, _, errs := parseDNSConf("", "test.dns-conf", []byte(b.String()))
+	if len(rrs) != 5000 || len(errs) != 5000 {
+		t.Fatalf("got %d records and %d errors, want 5000 of each", len(rrs), len(errs))
+	}
+	if got := errorLines(t, errs[len(errs)-1:])[0]; got != "9999" {
+		t.Errorf("last error at line %s, want 9999", got)
+	}
+}
+
+func TestParseDNSConfInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"zones/hosts.zone": strings.Join([]string{
+			"# hosts",                            // 1
+			"$TTL 300",                           // 2
+			"web IN A 10.0.1.1",                  // 3
+			"bad IN A not-an-ip",                 // 4 bad
+			"$GENERATE 1-2 node-$ A 10.0.2.$",    // 5
+			"$GENERATE 3-3 node-$ 30 A 10.0.2.$", // 6
+			"$INCLUDE missing.zone",              // 7 bad
+			"db IN A 10.0.1.2",                   // 8
+		}, "\n"),
+	})
+	conf := strings.Join([]string{
+		"$TTL 600",                                // 1
+		"bad IN A",                                // 2 bad
+		"$INCLUDE zones/hosts.zone example.",      // 3
+		"after.example. IN A 10.0.0.1",            // 4
+		"$GENERATE 1-1 gen-$.example. A 10.0.3.$", // 5
+		"also bad",                                // 6 bad
+	}, "\n")
+	rrs, _, errs := parseDNSConf(dir, filepath.Join(dir, "test.dns-conf"), []byte(conf))
+
+	var got []string
+	for i, err := range errs {
+		file := "test.dns-conf"
+		if strings.Contains(err.Error(), "hosts.zone") {
+			file = "hosts.zone"
+		}
+		got = append(got, file+":"+errorLines(t, errs)[i])
+	}
+	if want := "[test.dns-conf:2 hosts.zone:4 hosts.zone:7 test.dns-conf:6]"; fmt.Sprint(got) != want {
+		t.Errorf("errors = %v, want %s: %v", got, want, errs)
+	}
+
+	ttls := map[string]uint32{}
+	for _, rr := range rrs {
+		ttls[rr.Header().Name] = rr.Header().Ttl
+	}
+	want := map[string]uint32{
+		"web.example.":    300,
+		"node-1.example.": 300,
+		"node-2.example.": 300,
+		"node-3.example.": 30,
+		"db.example.":     300,
+		// 被包含的文件中的 $TTL 不影响当前文件
+		"after.example.": 600,
+		"gen-1.example.": 600,
+	}
+	if fmt.Sprint(ttls) != fmt.Sprint(want) {
+		t.Errorf("ttls = %v, want %v", ttls, want)
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeA {
+			t.Errorf("unexpected record %s", rr)
+		}
+	}
+}
+
+func TestParseDNSConfIncludeNotAllowed(t *testing.T) {
+	rrs, _, errs := parseDNSConf("", "remote", []byte("$INCLUDE /etc/passwd\na.example. IN A 10.0.0.1\n"))
+	if len(rrs) != 1 || len(errs) != 1 || !strings.Contains(errs[0].Error(), "not allowed") {
+		t.Errorf("got %v, %v, want one record and a not allowed error", rrs, errs)
+	}
+}
+
+// TestParseDNSConfGenerate $GENERATE 没有指定 TTL 的时候使用 $TTL，指定了的时候使用指定的 TTL
+func TestParseDNSConfGenerate(t *testing.T) {
+	tests := []struct {
+		desc string
+		conf string
+		want []string
+	}{
+		{"$TTL applied", "$TTL 600\n$GENERATE 1-2 host$.example. A 10.0.0.$", []string{
+			"host1.example.\t600\tIN\tA\t10.0.0.1", "host2.example.\t600\tIN\tA\t10.0.0.2"}},
+		{"$TTL applied with class", "$TTL 600\n$GENERATE 1-2 host$.example. IN A 10.0.0.$", []string{
+			"host1.example.\t600\tIN\tA\t10.0.0.1", "host2.example.\t600\tIN\tA\t10.0.0.2"}},
+		{"explicit TTL", "$TTL 600\n$GENERATE 1-2 host$.example. 60 A 10.0.0.$", []string{
+			"host1.example.\t60\tIN\tA\t10.0.0.1", "host2.example.\t60\tIN\tA\t10.0.0.2"}},
+		{"explicit TTL before class", "$TTL 600\n$GENERATE 1-2 host$.example. 60 IN A 10.0.0.$", []string{
+			"host1.example.\t60\tIN\tA\t10.0.0.1", "host2.example.\t60\tIN\tA\t10.0.0.2"}},
+		{"explicit TTL after class", "$TTL 600\n$GENERATE 1-2 host$.example. IN 60 A 10.0.0.$", []string{
+			"host1.example.\t60\tIN\tA\t10.0.0.1", "host2.example.\t60\tIN\tA\t10.0.0.2"}},
+		{"$TTL changed before $GENERATE", "$TTL 600\na.example. A 10.0.0.100\n$TTL 300\n$GENERATE 1-1 host$.example. A 10.0.0.$", []string{
+			"a.example.\t600\tIN\tA\t10.0.0.100", "host1.example.\t300\tIN\tA\t10.0.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			rrs, _, errs := parseDNSConf("", "test.dns-conf", []byte(tt.conf))
+			if len(errs) > 0 {
+				t.Fatalf("errors: %v", errs)
+			}
+			var got []string
+			for _, rr := range rrs {
+				got = append(got, rr.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("records =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}